@@ -0,0 +1,69 @@
+// Command db_tutorial is a shell for db_tutorial databases.
+//
+//	db_tutorial [flags] <database>
+//
+// Commands are read from standard input, with prompts and line editing if it
+// is a terminal.
+// Otherwise, or when they come from -f or -c, they run as a batch, which
+// stops at the first command that fails with a non-zero exit code.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/wss404/db_tutorial/db"
+)
+
+// commands collects the values of a flag that may be given more than once.
+type commands []string
+
+func (c *commands) String() string { return strings.Join(*c, "; ") }
+
+func (c *commands) Set(command string) error {
+	*c = append(*c, command)
+	return nil
+}
+
+func main() {
+	var opts db.ShellOptions
+	var cmds commands
+	flag.BoolVar(&opts.ReadOnly, "readonly", false, "open the database read-only")
+	flag.IntVar(&opts.PageSize, "pagesize", 0, "page size of the database in `bytes`, checked against the one it records and used to create a new one")
+	flag.DurationVar(&opts.BusyTimeout, "busy-timeout", 5*time.Second, "how long to wait for other processes using the database before failing")
+	flag.StringVar(&opts.Mode, "mode", "list", "output mode for selected rows: "+strings.Join(db.OutputModes, ", "))
+	flag.BoolVar(&opts.Headers, "headers", false, "print the names of the columns in the table and csv modes")
+	flag.Var(&cmds, "c", "run `command` and exit, may be given more than once")
+	file := flag.String("f", "", "read commands from `file`")
+	flag.StringVar(&opts.HistoryFile, "history", db.DefaultHistoryFile(), "keep the lines typed at a terminal in `file`, none if empty")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <database>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts.Commands = cmds
+	switch {
+	case cmds != nil:
+	case *file != "":
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(db.ExitFailure)
+		}
+		defer f.Close()
+		opts.Input = f
+	default:
+		info, err := os.Stdin.Stat()
+		opts.Prompt = err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+	code := db.RunShell(flag.Arg(0), &opts)
+	os.Exit(code)
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupHasUnflushedChanges(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	backup := filepath.Join(dir, "backup.db")
+	if err := os.WriteFile(backup, []byte("not a database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 1; i <= 300; i++ {
+		if err := db.Exec(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nothing is written back before Flush or Close
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Fatalf("database file already written: %v, %v", info, err)
+	}
+	if err := db.SaveTo(backup); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := Open(backup, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	if got := scan(t, copied); got != 300 {
+		t.Errorf("backup has %d rows, want 300", got)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestShellBackup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	backup := filepath.Join(dir, "backup.db")
+	var code int
+	out := captureStdout(t, func() {
+		code = RunShell(path, &ShellOptions{Commands: []string{
+			"insert 1 a a@example.com",
+			".backup " + backup,
+			"insert 2 b b@example.com",
+			".backup " + path,
+		}})
+	})
+	if code != ExitFailure || !strings.Contains(out, "over its own file") {
+		t.Fatalf("exit code %d, output:\n%s", code, out)
+	}
+
+	db, err := Open(backup, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get(1); err != nil {
+		t.Errorf("Get(1) from the backup: %v", err)
+	}
+	if _, err := db.Get(2); err != ErrNotFound {
+		t.Errorf("Get(2) from the backup: %v, want ErrNotFound", err)
+	}
+}
@@ -2,7 +2,6 @@ package db
 
 import (
 	"fmt"
-	"os"
 	"unsafe"
 )
 
@@ -11,6 +10,11 @@ type PageType uint8_t
 const (
 	PageLeaf PageType = iota
 	PageInternal
+	PageMeta
+	PageFree
+	PageKVLeaf
+	PageKVInternal
+	PageOverflow
 )
 
 type uint8_t uint8
@@ -37,12 +41,14 @@ const (
 const (
 	LeafNodeNextLeafSize   = uint32_t(unsafe.Sizeof(uint32_t(0)))
 	LeafNodeNextLeafOffset = uint32_t(0)
+	LeafNodePrevLeafSize   = uint32_t(unsafe.Sizeof(uint32_t(0)))
+	LeafNodePrevLeafOffset = LeafNodeNextLeafOffset + LeafNodeNextLeafSize
 	LeafNodeKeySize        = uint32_t(unsafe.Sizeof(uint32_t(0)))
-	LeafNodeKeyOffset      = LeafNodeNextLeafOffset + LeafNodeNextLeafOffset
+	LeafNodeKeyOffset      = LeafNodePrevLeafOffset + LeafNodePrevLeafSize
 	LeafNodeValueSize      = RowSize
 	LeafNodeValueOffset    = LeafNodeKeyOffset + LeafNodeKeySize
 	LeafNodeCellSize       = LeafNodeKeySize + LeafNodeValueSize
-	LeafNodeSpaceForCells  = PageSize - LeafNodeHeaderSize - LeafNodeNextLeafSize
+	LeafNodeSpaceForCells  = PageSize - LeafNodeHeaderSize - LeafNodeNextLeafSize - LeafNodePrevLeafSize
 	LeafNodeMaxCells       = LeafNodeSpaceForCells / LeafNodeCellSize
 )
 
@@ -93,6 +99,7 @@ func (p *LeafPage) initializeLeafNode() {
 	//p.setNodeRoot(false)
 	*p.leafNodeNumCells() = 0
 	*p.leafNodeNextLeaf() = 0
+	*p.leafNodePrevLeaf() = 0
 }
 
 func (p *LeafPage) printLeafNode() {
@@ -104,16 +111,33 @@ func (p *LeafPage) printLeafNode() {
 	}
 }
 
-func (c *Cursor) leafNodeSplitAndInsert(key uint32_t, value *Row) {
-	oldHeader, oldBody := c.table.pager.getPage(c.pageNum)
+func (c *Cursor) leafNodeSplitAndInsert(key uint32_t, value *Row) error {
+	oldHeader, oldBody, err := c.table.pager.getPage(c.pageNum)
+	if err != nil {
+		return err
+	}
 	oldPage := &LeafPage{header: oldHeader, body: (*LeafPageBody)(oldBody)}
-	oldMax := oldPage.getMaxKey()
 	newPageNum := c.table.pager.getUnusedPageNum()
-	newHeader, newBody := c.table.pager.getPage(newPageNum)
+	newHeader, newBody, err := c.table.pager.getPage(newPageNum)
+	if err != nil {
+		return err
+	}
 	newPage := &LeafPage{header: newHeader, body: (*LeafPageBody)(newBody)}
 	newPage.initializeLeafNode()
 	newPage.header.parentPointer = oldPage.header.parentPointer
 	*newPage.leafNodeNextLeaf() = *oldPage.leafNodeNextLeaf()
+	*newPage.leafNodePrevLeaf() = c.pageNum
+	if nextPageNum := *oldPage.leafNodeNextLeaf(); nextPageNum != 0 {
+		// siblings are only latched left to right, while holding the parent
+		c.table.pager.latch(nextPageNum)
+		nextHeader, nextBody, err := c.table.pager.getPage(nextPageNum)
+		if err != nil {
+			return err
+		}
+		nextPage := LeafPage{header: nextHeader, body: (*LeafPageBody)(nextBody)}
+		*nextPage.leafNodePrevLeaf() = newPageNum
+		c.table.pager.markDirty(nextPageNum)
+	}
 	*oldPage.leafNodeNextLeaf() = newPageNum
 
 	// TODO:有待改进
@@ -139,28 +163,28 @@ func (c *Cursor) leafNodeSplitAndInsert(key uint32_t, value *Row) {
 
 	*(oldPage.leafNodeNumCells()) = LeafNodeLeftSpiltCount
 	*(newPage.leafNodeNumCells()) = LeafNodeRightSplitCount
+	c.table.pager.markDirty(c.pageNum)
+	c.table.pager.markDirty(newPageNum)
 
 	if oldPage.header.isRoot != 0 {
-		c.table.createNewRoot(newPageNum)
-	} else {
-		parentPageNum := oldPage.header.parentPointer
-		newMax := oldPage.getMaxKey()
-		parentHeader, parentBody := c.table.pager.getPage(parentPageNum)
-		parentPage := InternalPage{
-			header: parentHeader,
-			body: (*InternalPageBody)(parentBody),
-		}
-		parentPage.updateInternalNodeKey(oldMax, newMax)
-		c.table.internalNodeInsert(parentPageNum, newPageNum)
+		return c.table.createNewRoot(oldPage.getMaxKey(), newPageNum)
 	}
+	return c.table.internalNodeInsert(c.path, c.pageNum, oldPage.getMaxKey(), newPageNum)
 }
 
-func (p *Pager) getUnusedPageNum() uint32_t { return p.numPages }
-
-func (t *Table) createNewRoot(rightChildPageNum uint32_t) {
-	rootHeader, rootBody := t.pager.getPage(t.rootPageNum)
+// createNewRoot moves the root's contents to a new left child and turns the
+// root into an internal node over it and rightChildPageNum, split at
+// separator, the largest key under the left child.
+func (t *Table) createNewRoot(separator, rightChildPageNum uint32_t) error {
+	rootHeader, rootBody, err := t.pager.getPage(t.rootPageNum)
+	if err != nil {
+		return err
+	}
 	leftChildPageNum := t.pager.getUnusedPageNum()
-	leftChildHeader, leftChildBody := t.pager.getPage(leftChildPageNum)
+	leftChildHeader, leftChildBody, err := t.pager.getPage(leftChildPageNum)
+	if err != nil {
+		return err
+	}
 	leftChild := LeafPage{header: leftChildHeader, body: (*LeafPageBody)(leftChildBody)}
 
 	copy((*[PageHeaderSize]byte)(unsafe.Pointer(leftChildHeader))[:],
@@ -169,25 +193,28 @@ func (t *Table) createNewRoot(rightChildPageNum uint32_t) {
 	leftChild.setNodeRoot(false)
 
 	newRootHeader := new(PageHeader)
-	newRootBody := new(InternalPageBody)
-	newRoot := InternalPage{header: newRootHeader, body: newRootBody}
+	newRootBody := new([PageBodySize]byte) // a whole page body, flush writes PageBodySize bytes
+	newRoot := InternalPage{header: newRootHeader, body: (*InternalPageBody)(unsafe.Pointer(newRootBody))}
 	newRoot.initializeInternalNode()
 	newRoot.setNodeRoot(true)
 	*(newRoot.internalNodeNumKeys()) = 1
-	*(newRoot.internalNodeChild(0)) = leftChildPageNum
-	leftChildMaxKey := leftChild.getMaxKey()
-	*(newRoot.internalNodeKey(0)) = leftChildMaxKey
+	*(newRoot.internalNodeCell(0)) = InternalPageCell{value: leftChildPageNum, key: separator}
 	*(newRoot.internalNodeRightChild()) = rightChildPageNum
-	rightChildHeader, _ := t.pager.getPage(rightChildPageNum)
+	rightChildHeader, rightChildBody, err := t.pager.getPage(rightChildPageNum)
+	if err != nil {
+		return err
+	}
+	if rightChildHeader.pageType == PageLeaf {
+		// the old root's cells now live in the left child
+		rightChild := LeafPage{header: rightChildHeader, body: (*LeafPageBody)(rightChildBody)}
+		*rightChild.leafNodePrevLeaf() = leftChildPageNum
+	}
 	leftChild.header.parentPointer = t.rootPageNum
 	rightChildHeader.parentPointer = t.rootPageNum
-	t.pager.headers[t.rootPageNum] = newRootHeader
-	t.pager.bodies[t.rootPageNum] = unsafe.Pointer(newRootBody)
-}
-
-func (p *InternalPage) updateInternalNodeKey(oldKey, newKey uint32_t) {
-	oldChildIndex := p.internalNodeFindChild(oldKey)
-	*p.internalNodeKey(oldChildIndex) = newKey
+	t.pager.markDirty(leftChildPageNum)
+	t.pager.markDirty(rightChildPageNum)
+	t.pager.setPage(t.rootPageNum, newRootHeader, unsafe.Pointer(newRootBody))
+	return nil
 }
 
 func (p *InternalPage) internalNodeNumKeys() *uint32_t {
@@ -205,15 +232,14 @@ func (p *InternalPage) internalNodeCell(cellNum uint32_t) *InternalPageCell {
 	return &(p.body.cells[cellNum])
 }
 
-func (p *InternalPage) internalNodeChild(childNum uint32_t) *uint32_t {
+func (p *InternalPage) internalNodeChild(childNum uint32_t) (*uint32_t, error) {
 	numKeys := p.header.numCells
 	if childNum > numKeys {
-		fmt.Printf("Tried to access child_num %d > num_keys %d\n", childNum, numKeys)
-		os.Exit(ExitFailure)
+		return nil, fmt.Errorf("%w: tried to access child_num %d > num_keys %d", ErrCorrupt, childNum, numKeys)
 	} else if childNum == numKeys {
-		return p.internalNodeRightChild()
+		return p.internalNodeRightChild(), nil
 	}
-	return &(p.internalNodeCell(childNum).value)
+	return &(p.internalNodeCell(childNum).value), nil
 }
 
 func (p *InternalPage) internalNodeKey(keyNum uint32_t) *uint32_t {
@@ -260,8 +286,11 @@ func indent(level uint32_t) {
 	}
 }
 
-func (p *Pager) printTree(pageNum, indentationLevel uint32_t) {
-	header, body := p.getPage(pageNum)
+func (p *Pager) printTree(pageNum, indentationLevel uint32_t) error {
+	header, body, err := p.getPage(pageNum)
+	if err != nil {
+		return err
+	}
 
 	switch header.pageType {
 	case PageLeaf:
@@ -279,15 +308,21 @@ func (p *Pager) printTree(pageNum, indentationLevel uint32_t) {
 		indent(indentationLevel)
 		fmt.Printf("- internal (size %d)\n", numKeys)
 		for i := uint32_t(0); i < numKeys; i++ {
-			child := *internalPage.internalNodeChild(i)
-			p.printTree(child, indentationLevel+1)
+			child, err := internalPage.internalNodeChild(i)
+			if err != nil {
+				return err
+			}
+			if err := p.printTree(*child, indentationLevel+1); err != nil {
+				return err
+			}
 
 			indent(indentationLevel + 1)
 			fmt.Printf("- key %d\n", *internalPage.internalNodeKey(i))
 		}
 		child := *internalPage.internalNodeRightChild()
-		p.printTree(child, indentationLevel+1)
+		return p.printTree(child, indentationLevel+1)
 	}
+	return nil
 }
 
 func (p *InternalPage) internalNodeFindChild(key uint32_t) uint32_t {
@@ -306,68 +341,118 @@ func (p *InternalPage) internalNodeFindChild(key uint32_t) uint32_t {
 	return minIndex
 }
 
-func (t *Table) internalNodeFind(pageNum, key uint32_t) *Cursor {
-	header, body := t.pager.getPage(pageNum)
+// internalNodeFind descends from an internal page, latching each child
+// before letting go of the pages above it that a split of the child can no
+// longer reach (latch crabbing).
+func (t *Table) internalNodeFind(pageNum, key uint32_t) (*Cursor, error) {
+	header, body, err := t.pager.getPage(pageNum)
+	if err != nil {
+		return nil, err
+	}
 	internalPage := &InternalPage{header: header, body: (*InternalPageBody)(body)}
 	childIndex := internalPage.internalNodeFindChild(key)
-	childNum := *internalPage.internalNodeChild(childIndex)
-	childHeader, _ := t.pager.getPage(childNum)
+	child, err := internalPage.internalNodeChild(childIndex)
+	if err != nil {
+		return nil, err
+	}
+	childNum := *child
+	t.pager.latch(childNum)
+	childHeader, _, err := t.pager.getPage(childNum)
+	if err != nil {
+		return nil, err
+	}
+	if childHeader.hasRoom() {
+		t.pager.unlatchAllBut(childNum)
+	}
+	var cursor *Cursor
 	switch childHeader.pageType {
 	case PageLeaf:
-		return t.leafNodeFind(childNum, key)
+		cursor, err = t.leafNodeFind(childNum, key)
 	default:
-		return t.internalNodeFind(childNum, key)
+		cursor, err = t.internalNodeFind(childNum, key)
+	}
+	if err != nil {
+		return nil, err
 	}
+	cursor.path = append([]uint32_t{pageNum}, cursor.path...)
+	return cursor, nil
+}
+
+// hasRoom reports whether a row table node can take one more cell without
+// splitting.
+func (h *PageHeader) hasRoom() bool {
+	if h.pageType == PageLeaf {
+		return h.numCells < LeafNodeMaxCells
+	}
+	return h.numCells < InternalNodeMaxCells
 }
 
 func (p *LeafPage) leafNodeNextLeaf() *uint32_t {
 	return &(p.body.nextLeaf)
 }
 
-func (t *Table) internalNodeInsert(parentPageNum, childPageNum uint32_t) {
-	parentHeader, parentBody := t.pager.getPage(parentPageNum)
+func (p *LeafPage) leafNodePrevLeaf() *uint32_t {
+	return &(p.body.prevLeaf)
+}
+
+// internalNodeInsert records in the last page of path that its child
+// childPageNum has split at separator, with the upper half moved to
+// newPageNum. A full page splits in turn, up the path.
+func (t *Table) internalNodeInsert(path []uint32_t, childPageNum, separator, newPageNum uint32_t) error {
+	parentPageNum := path[len(path)-1]
+	parentHeader, parentBody, err := t.pager.getPage(parentPageNum)
+	if err != nil {
+		return err
+	}
 	parentPage := InternalPage{header: parentHeader, body: (*InternalPageBody)(parentBody)}
-	childHeader, childBody := t.pager.getPage(childPageNum)
-	var childMaxKey uint32_t
-	if childHeader.pageType == PageLeaf {
-		childPage := LeafPage{header: childHeader, body: (*LeafPageBody)(childBody)}
-		childMaxKey = childPage.getMaxKey()
-	} else {
-		childPage := InternalPage{header: childHeader, body: (*InternalPageBody)(childBody)}
-		childMaxKey = childPage.getMaxKey()
+	keys, children := parentPage.internalNodeEntries()
+	index := parentPage.internalNodeFindChild(separator)
+	if children[index] != childPageNum {
+		return fmt.Errorf("%w: page %d is not a child of page %d", ErrCorrupt, childPageNum, parentPageNum)
 	}
-	index := parentPage.internalNodeFindChild(childMaxKey)
-
-	originalNumKeys := *parentPage.internalNodeNumKeys()
-	*parentPage.internalNodeNumKeys() = originalNumKeys + 1
-
-	if originalNumKeys >= InternalNodeMaxCells {
-		fmt.Println("Need to implement splitting internal node")
-		os.Exit(ExitFailure)
+	// the child keeps the keys up to separator, its old key now bounds newPageNum
+	keys = append(keys[:index], append([]uint32_t{separator}, keys[index:]...)...)
+	children = append(children[:index+1], append([]uint32_t{newPageNum}, children[index+1:]...)...)
+	if len(keys) <= int(InternalNodeMaxCells) {
+		parentPage.setInternalNodeEntries(keys, children)
+		t.pager.markDirty(parentPageNum)
+		return nil
 	}
 
-	rightChildPageNum := *parentPage.internalNodeRightChild()
-	rightChildHeader, rightChildBody := t.pager.getPage(rightChildPageNum)
+	split := len(keys) / 2
+	siblingPageNum := t.pager.getUnusedPageNum()
+	siblingHeader, siblingBody, err := t.pager.getPage(siblingPageNum)
+	if err != nil {
+		return err
+	}
+	siblingPage := InternalPage{header: siblingHeader, body: (*InternalPageBody)(siblingBody)}
+	siblingPage.initializeInternalNode()
+	siblingPage.header.parentPointer = parentPage.header.parentPointer
+	siblingPage.setInternalNodeEntries(keys[split+1:], children[split+1:])
+	parentPage.setInternalNodeEntries(keys[:split], children[:split+1])
+	t.pager.markDirty(siblingPageNum)
+	t.pager.markDirty(parentPageNum)
+	if parentPage.isNodeRoot() {
+		return t.createNewRoot(keys[split], siblingPageNum)
+	}
+	return t.internalNodeInsert(path[:len(path)-1], parentPageNum, keys[split], siblingPageNum)
+}
 
-	var rightChildMaxKey uint32_t
-	if rightChildHeader.pageType == PageLeaf {
-		rightChildPage := &LeafPage{header: rightChildHeader, body: (*LeafPageBody)(rightChildBody)}
-		rightChildMaxKey = rightChildPage.getMaxKey()
-	} else {
-		rightChildPage := &InternalPage{header: rightChildHeader, body: (*InternalPageBody)(rightChildBody)}
-		rightChildMaxKey = rightChildPage.getMaxKey()
+// internalNodeEntries returns the keys of an internal node and its children,
+// the right child last.
+func (p *InternalPage) internalNodeEntries() (keys, children []uint32_t) {
+	numKeys := *p.internalNodeNumKeys()
+	for i := uint32_t(0); i < numKeys; i++ {
+		keys = append(keys, *p.internalNodeKey(i))
+		children = append(children, p.internalNodeCell(i).value)
 	}
-	if childMaxKey > rightChildMaxKey {
-		*parentPage.internalNodeChild(originalNumKeys) = rightChildPageNum
-		*parentPage.internalNodeKey(originalNumKeys) = rightChildMaxKey
-		*parentPage.internalNodeRightChild() = childPageNum
-	} else {
-		for i := originalNumKeys; i > index; i-- {
-			destination := parentPage.internalNodeCell(i)
-			source := parentPage.internalNodeCell(i-1)
-			source.moveTo(destination)
-		}
-		*parentPage.internalNodeChild(index) = childPageNum
-		*parentPage.internalNodeKey(index) = childMaxKey
+	return keys, append(children, *p.internalNodeRightChild())
+}
+
+func (p *InternalPage) setInternalNodeEntries(keys, children []uint32_t) {
+	for i, key := range keys {
+		*p.internalNodeCell(uint32_t(i)) = InternalPageCell{value: children[i], key: key}
 	}
-}
\ No newline at end of file
+	*p.internalNodeNumKeys() = uint32_t(len(keys))
+	*p.internalNodeRightChild() = children[len(keys)]
+}
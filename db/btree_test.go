@@ -0,0 +1,58 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestInsertSplitsInternalNodes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 2000
+	ids := rand.New(rand.NewSource(1)).Perm(n)
+	for _, id := range ids {
+		if err := db.Exec(fmt.Sprintf("insert %d user%d person%d@example.com", id+1, id+1, id+1)); err != nil {
+			t.Fatalf("insert %d: %v", id+1, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("select")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := uint32(1)
+	for rows.Next() {
+		if id := rows.Row().ID(); id != want {
+			t.Fatalf("got row %d, want %d", id, want)
+		}
+		want++
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want != n+1 {
+		t.Fatalf("got %d rows, want %d", want-1, n)
+	}
+	for _, id := range []uint32{1, 2, 777, n - 1, n} {
+		row, err := db.Get(id)
+		if err != nil {
+			t.Fatalf("Get(%d): %v", id, err)
+		}
+		if got := row.Username(); got != fmt.Sprintf("user%d", id) {
+			t.Errorf("Get(%d): username %q", id, got)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	// ErrBucketExists is returned when creating a bucket that already exists.
+	ErrBucketExists = errors.New("db: bucket already exists")
+	// ErrBucketNotFound is returned when opening or deleting a missing bucket.
+	ErrBucketNotFound = errors.New("db: bucket not found")
+	// ErrIncompatibleValue is returned when using a bucket as a plain value or
+	// a plain value as a bucket.
+	ErrIncompatibleValue = errors.New("db: incompatible value")
+	// ErrBucketMoved is returned when using a Bucket obtained before a vacuum,
+	// which moved the bucket's pages. The bucket must be opened again.
+	ErrBucketMoved = errors.New("db: bucket moved by a vacuum")
+)
+
+// Bucket is a B-tree of byte-slice keys and values, kept in key order by
+// bytes.Compare. Keys may be up to MaxKeySize bytes, values up to
+// MaxValueSize bytes; large values are stored on overflow pages.
+//
+// A bucket can hold nested buckets, each with a tree of its own whose root is
+// recorded in the parent's entry for it.
+//
+// A Bucket obtained from a DB runs each change in its own transaction, one
+// obtained from a Tx runs them inside that transaction. Nested buckets
+// inherit this from their parent. Changes through a Bucket of a read-only
+// transaction fail with ErrTxReadOnly. A Bucket must not be used after it has
+// been deleted. A vacuum, in this process or another, moves every bucket, and
+// a Bucket obtained before it then fails with ErrBucketMoved.
+type Bucket struct {
+	db          *DB
+	tx          *Tx
+	rootPageNum uint32_t
+	generation  uint32_t // of the pages rootPageNum was found in
+}
+
+// KV returns the database's top level key/value bucket.
+func (db *DB) KV() (*Bucket, error) {
+	return db.kv(nil)
+}
+
+// KV returns the database's top level key/value bucket, bound to the
+// transaction.
+func (tx *Tx) KV() (*Bucket, error) {
+	return tx.db.kv(tx)
+}
+
+func (db *DB) kv(tx *Tx) (*Bucket, error) {
+	var bucket *Bucket
+	err := db.view(tx, func(t *Table) error {
+		meta, err := t.pager.meta()
+		if err != nil {
+			return err
+		}
+		bucket = &Bucket{db: db, tx: tx, rootPageNum: meta.kvRoot, generation: t.pager.pageGeneration()}
+		return nil
+	})
+	return bucket, err
+}
+
+// Put sets the value of key, replacing any existing value.
+func (b *Bucket) Put(key, value []byte) error {
+	if err := checkPut(key, value); err != nil {
+		return err
+	}
+	return b.update(func(p *Pager) error {
+		return p.bucketPut(b.rootPageNum, key, value)
+	})
+}
+
+// checkPut checks that a key and value are not too large to put.
+func checkPut(key, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyRequired
+	} else if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	} else if len(value) > MaxValueSize {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// bucketPut sets the value of key in the bucket at rootPageNum.
+func (p *Pager) bucketPut(rootPageNum uint32_t, key, value []byte) error {
+	if inode, err := p.kvGet(rootPageNum, key); err == nil && inode.flags&kvFlagBucket != 0 {
+		return ErrIncompatibleValue
+	}
+	stored, flags, err := p.storeValue(key, value)
+	if err != nil {
+		return err
+	}
+	return p.kvPut(rootPageNum, kvInode{flags: flags, key: append([]byte(nil), key...), value: stored})
+}
+
+// Get returns a copy of the value of key, or ErrNotFound.
+func (b *Bucket) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := b.view(func(p *Pager) error {
+		inode, err := p.kvGet(b.rootPageNum, key)
+		if err != nil {
+			return err
+		}
+		if inode.flags&kvFlagBucket != 0 {
+			return ErrIncompatibleValue
+		}
+		value, err = p.loadValue(inode)
+		return err
+	})
+	return value, err
+}
+
+// Delete removes key from the bucket, or returns ErrNotFound.
+func (b *Bucket) Delete(key []byte) error {
+	return b.update(func(p *Pager) error {
+		if inode, err := p.kvGet(b.rootPageNum, key); err == nil && inode.flags&kvFlagBucket != 0 {
+			return ErrIncompatibleValue
+		}
+		return p.kvDelete(b.rootPageNum, key)
+	})
+}
+
+// Bucket returns the nested bucket called name, or ErrBucketNotFound.
+func (b *Bucket) Bucket(name []byte) (*Bucket, error) {
+	var bucket *Bucket
+	err := b.view(func(p *Pager) error {
+		rootPageNum, err := p.bucketRoot(b.rootPageNum, name)
+		if err != nil {
+			return err
+		}
+		bucket = &Bucket{db: b.db, tx: b.tx, rootPageNum: rootPageNum, generation: b.generation}
+		return nil
+	})
+	return bucket, err
+}
+
+// bucketRoot returns the root page of the bucket called name nested in the
+// one at rootPageNum.
+func (p *Pager) bucketRoot(rootPageNum uint32_t, name []byte) (uint32_t, error) {
+	inode, err := p.kvGet(rootPageNum, name)
+	if err == ErrNotFound {
+		return 0, ErrBucketNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	if inode.flags&kvFlagBucket == 0 {
+		return 0, ErrIncompatibleValue
+	}
+	return uint32_t(binary.LittleEndian.Uint32(inode.value)), nil
+}
+
+// CreateBucket creates a nested bucket called name, or returns
+// ErrBucketExists.
+func (b *Bucket) CreateBucket(name []byte) (*Bucket, error) {
+	if len(name) == 0 {
+		return nil, ErrKeyRequired
+	} else if len(name) > MaxKeySize {
+		return nil, ErrKeyTooLarge
+	}
+	var bucket *Bucket
+	err := b.update(func(p *Pager) error {
+		rootPageNum, err := p.createBucket(b.rootPageNum, name)
+		if err != nil {
+			return err
+		}
+		bucket = &Bucket{db: b.db, tx: b.tx, rootPageNum: rootPageNum, generation: b.generation}
+		return nil
+	})
+	return bucket, err
+}
+
+// createBucket creates a bucket called name nested in the one at rootPageNum
+// and returns its root page.
+func (p *Pager) createBucket(rootPageNum uint32_t, name []byte) (uint32_t, error) {
+	if inode, err := p.kvGet(rootPageNum, name); err == nil {
+		if inode.flags&kvFlagBucket != 0 {
+			return 0, ErrBucketExists
+		}
+		return 0, ErrIncompatibleValue
+	} else if err != ErrNotFound {
+		return 0, err
+	}
+	bucketRoot, err := p.allocatePage()
+	if err != nil {
+		return 0, err
+	}
+	if err := p.writeKVNode(&kvNode{pageNum: bucketRoot, isLeaf: true}); err != nil {
+		return 0, err
+	}
+	value := make([]byte, 4)
+	binary.LittleEndian.PutUint32(value, uint32(bucketRoot))
+	inode := kvInode{flags: kvFlagBucket, key: append([]byte(nil), name...), value: value}
+	if err := p.kvPut(rootPageNum, inode); err != nil {
+		return 0, err
+	}
+	return bucketRoot, nil
+}
+
+// CreateBucketIfNotExists returns the nested bucket called name, creating it
+// if it does not exist.
+func (b *Bucket) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
+	bucket, err := b.CreateBucket(name)
+	if err == ErrBucketExists {
+		return b.Bucket(name)
+	}
+	return bucket, err
+}
+
+// DeleteBucket deletes the nested bucket called name with everything in it,
+// returning all of its pages to the freelist.
+func (b *Bucket) DeleteBucket(name []byte) error {
+	return b.update(func(p *Pager) error {
+		inode, err := p.kvGet(b.rootPageNum, name)
+		if err == ErrNotFound {
+			return ErrBucketNotFound
+		} else if err != nil {
+			return err
+		}
+		if inode.flags&kvFlagBucket == 0 {
+			return ErrIncompatibleValue
+		}
+		if err := p.kvFreeTree(uint32_t(binary.LittleEndian.Uint32(inode.value))); err != nil {
+			return err
+		}
+		return p.kvDelete(b.rootPageNum, name)
+	})
+}
+
+// Buckets returns the names of the nested buckets in key order.
+func (b *Bucket) Buckets() ([][]byte, error) {
+	var names [][]byte
+	err := b.view(func(p *Pager) error {
+		_, err := p.kvScan(b.rootPageNum, nil, func(inode kvInode) (bool, error) {
+			if inode.flags&kvFlagBucket != 0 {
+				names = append(names, inode.key)
+			}
+			return true, nil
+		})
+		return err
+	})
+	return names, err
+}
+
+// ForEach calls fn for every key/value pair in key order, with a nil value
+// for nested buckets. Iteration stops at the first error fn returns, which
+// ForEach then returns. Outside a transaction that changes the database, the
+// iteration sees the bucket as it was when ForEach was called; inside one, fn
+// must not change the bucket.
+func (b *Bucket) ForEach(fn func(key, value []byte) error) error {
+	return b.Range(nil, nil, fn)
+}
+
+// Range calls fn like ForEach for the keys from start up to but not including
+// end. A nil start or end leaves that side of the range open.
+func (b *Bucket) Range(start, end []byte, fn func(key, value []byte) error) error {
+	return b.scan(start, func(key []byte) bool {
+		return end == nil || bytes.Compare(key, end) < 0
+	}, fn)
+}
+
+// Prefix calls fn like ForEach for the keys that start with prefix.
+func (b *Bucket) Prefix(prefix []byte, fn func(key, value []byte) error) error {
+	return b.scan(prefix, func(key []byte) bool {
+		return bytes.HasPrefix(key, prefix)
+	}, fn)
+}
+
+func (b *Bucket) scan(start []byte, inRange func(key []byte) bool, fn func(key, value []byte) error) error {
+	return b.view(func(p *Pager) error {
+		_, err := p.kvScan(b.rootPageNum, start, func(inode kvInode) (bool, error) {
+			if !inRange(inode.key) {
+				return false, nil
+			}
+			if inode.flags&kvFlagBucket != 0 {
+				return true, fn(inode.key, nil)
+			}
+			value, err := p.loadValue(inode)
+			if err != nil {
+				return false, err
+			}
+			return true, fn(inode.key, value)
+		})
+		return err
+	})
+}
+
+func (b *Bucket) view(fn func(p *Pager) error) error {
+	return b.db.view(b.tx, func(t *Table) error {
+		return b.use(t.pager, fn)
+	})
+}
+
+func (b *Bucket) update(fn func(p *Pager) error) error {
+	if b.tx != nil {
+		if b.tx.readOnly {
+			return ErrTxReadOnly
+		}
+		return b.view(fn)
+	}
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := b.use(tx.table.pager, fn); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// use calls fn with p unless the pages have been moved since the bucket was
+// found.
+func (b *Bucket) use(p *Pager, fn func(p *Pager) error) error {
+	if p.pageGeneration() != b.generation {
+		return ErrBucketMoved
+	}
+	return fn(p)
+}
@@ -0,0 +1,211 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// freePages returns the number of pages on the freelist.
+func freePages(t *testing.T, db *DB) int {
+	t.Helper()
+	p := db.table.pager
+	meta, err := p.meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for pageNum := meta.freelist; pageNum != 0; n++ {
+		_, body, err := p.getPage(pageNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pageNum = (*FreePageBody)(body).next
+	}
+	return n
+}
+
+func TestNestedBuckets(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	root, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := root
+	path := []string{"a", "b", "c"}
+	for _, name := range path {
+		if bucket, err = bucket.CreateBucket([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := bucket.Put([]byte("depth"), []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bucket = root
+	for _, name := range path {
+		if bucket, err = bucket.Bucket([]byte(name)); err != nil {
+			t.Fatalf("Bucket(%q): %v", name, err)
+		}
+		value, err := bucket.Get([]byte("depth"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != name {
+			t.Errorf("bucket %s holds depth %q", name, value)
+		}
+	}
+
+	a, err := root.Bucket([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		fn   func() error
+		want error
+	}{
+		{"CreateBucket of an existing bucket", func() error {
+			_, err := root.CreateBucket([]byte("a"))
+			return err
+		}, ErrBucketExists},
+		{"CreateBucket over a value", func() error {
+			_, err := a.CreateBucket([]byte("depth"))
+			return err
+		}, ErrIncompatibleValue},
+		{"Bucket of a value", func() error {
+			_, err := a.Bucket([]byte("depth"))
+			return err
+		}, ErrIncompatibleValue},
+		{"Bucket of a missing bucket", func() error {
+			_, err := a.Bucket([]byte("missing"))
+			return err
+		}, ErrBucketNotFound},
+		{"Put over a bucket", func() error { return a.Put([]byte("b"), []byte("v")) }, ErrIncompatibleValue},
+		{"Get of a bucket", func() error {
+			_, err := a.Get([]byte("b"))
+			return err
+		}, ErrIncompatibleValue},
+		{"Delete of a bucket", func() error { return a.Delete([]byte("b")) }, ErrIncompatibleValue},
+		{"DeleteBucket of a value", func() error { return a.DeleteBucket([]byte("depth")) }, ErrIncompatibleValue},
+		{"DeleteBucket of a missing bucket", func() error { return a.DeleteBucket([]byte("missing")) }, ErrBucketNotFound},
+	}
+	for _, test := range tests {
+		if err := test.fn(); !errors.Is(err, test.want) {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.want)
+		}
+	}
+	if again, err := root.CreateBucketIfNotExists([]byte("a")); err != nil {
+		t.Fatal(err)
+	} else if again.rootPageNum != a.rootPageNum {
+		t.Error("CreateBucketIfNotExists did not return the existing bucket")
+	}
+}
+
+func TestDeleteBucketFreesPages(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	root, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	numPages := db.table.pager.numPages
+	bucket, err := root.CreateBucket([]byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested, err := bucket.CreateBucket([]byte("nested"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		if err := bucket.Put(key, valueFor(key, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nested.Put([]byte("big"), bytes.Repeat([]byte("x"), 3*int(PageSize))); err != nil {
+		t.Fatal(err)
+	}
+	used := int(db.table.pager.numPages - numPages)
+	free := freePages(t, db)
+
+	if err := root.DeleteBucket([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.Bucket([]byte("b")); !errors.Is(err, ErrBucketNotFound) {
+		t.Errorf("Bucket after DeleteBucket: err = %v, want ErrBucketNotFound", err)
+	}
+	if got := freePages(t, db) - free; got != used {
+		t.Errorf("DeleteBucket freed %d pages, the bucket used %d", got, used)
+	}
+
+	// a new bucket takes a freed page rather than growing the file
+	if _, err := root.CreateBucket([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.table.pager.numPages - numPages; int(got) != used {
+		t.Errorf("file grew by %d pages in all, want the %d the first bucket took", got, used)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	root, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func(b *Bucket) string {
+		t.Helper()
+		list, err := b.Buckets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s []string
+		for _, name := range list {
+			s = append(s, string(name))
+		}
+		return strings.Join(s, " ")
+	}
+	if got := names(root); got != "" {
+		t.Errorf("Buckets of an empty database = %q", got)
+	}
+	for _, name := range []string{"c", "a", "b"} {
+		if _, err := root.CreateBucket([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := root.Put([]byte("plain"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	a, err := root.Bucket([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.CreateBucket([]byte("inner")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		bucket *Bucket
+		want   string
+	}{
+		{"top level", root, "a b c"},
+		{"nested", a, "inner"},
+	}
+	for _, test := range tests {
+		if got := names(test.bucket); got != test.want {
+			t.Errorf("%s: Buckets() = %q, want %q", test.name, got, test.want)
+		}
+	}
+	if err := root.DeleteBucket([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(root); got != "a c" {
+		t.Errorf("Buckets() after DeleteBucket = %q, want \"a c\"", got)
+	}
+}
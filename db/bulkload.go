@@ -0,0 +1,380 @@
+package db
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"unsafe"
+)
+
+// LoadOptions configures DB.Load. A nil *LoadOptions selects the defaults.
+type LoadOptions struct {
+	// FillFactor is how full Load fills the pages it builds, a fraction above
+	// 0 and up to 1. Zero fills them completely. Room left in the leaves
+	// lets later inserts among the loaded rows go in without splitting them.
+	FillFactor float64
+	// Sorted promises that the rows come in increasing id order, so that
+	// Load need not sort them first. Rows out of order then fail the load.
+	Sorted bool
+}
+
+// loadRunRows is how many rows Load sorts in memory at once, about 19MB of
+// them. More are sorted in runs of this many written to temporary files.
+const loadRunRows = 1 << 16
+
+// NewRow returns a row for Load. It fails with ErrSyntax if a string is too
+// long for its column.
+func NewRow(id uint32, username, email string) (Row, error) {
+	if len(username) > ColumnUsernameSize || len(email) > ColumnEmailSize {
+		return Row{}, fmt.Errorf("%w: string is too long", ErrSyntax)
+	}
+	row := Row{id: uint32_t(id)}
+	copy(row.username[:], username)
+	copy(row.email[:], email)
+	return row, nil
+}
+
+// Load adds the rows next returns, until it returns io.EOF, in a single
+// transaction, and returns how many there were. Rather than inserting them one
+// at a time it builds the table anew from the bottom up, merged with the rows
+// already in it: first the leaves, one after another in id order, then each
+// level of internal pages over them. The new pages come from the freelist
+// before the end of the file, and the pages of the old table go on the
+// freelist once it is built, for later loads and buckets to reuse. The whole
+// new tree is held in the transaction's memory until it commits.
+//
+// The rows are sorted first unless opts.Sorted is set. An id that is already
+// taken, or given twice, fails the whole load with ErrDuplicateKey.
+func (db *DB) Load(next func() (Row, error), opts *LoadOptions) (int, error) {
+	if opts == nil {
+		opts = new(LoadOptions)
+	}
+	fill, err := fillFactor(opts.FillFactor)
+	if err != nil {
+		return 0, err
+	}
+	var row Row
+	source := func() (*Row, error) {
+		var err error
+		if row, err = next(); err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return &row, nil
+	}
+	if !opts.Sorted {
+		sorter := new(rowSorter)
+		defer sorter.close()
+		for {
+			row, err := next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return 0, err
+			}
+			if err := sorter.add(&row); err != nil {
+				return 0, err
+			}
+		}
+		if source, err = sorter.sorted(); err != nil {
+			return 0, err
+		}
+	}
+
+	tx, err := db.begin(false)
+	if err != nil {
+		return 0, err
+	}
+	n, err := tx.table.loadRows(source, fill)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// fillFactor checks a fill factor, zero standing for 1.
+func fillFactor(fill float64) (float64, error) {
+	if fill == 0 {
+		return 1, nil
+	}
+	if !(fill > 0 && fill <= 1) {
+		return 0, fmt.Errorf("fill factor %v is not above 0 and up to 1", fill)
+	}
+	return fill, nil
+}
+
+// loadRows builds the table anew, as Load does, from its rows and those next
+// returns in increasing id order, and returns how many next returned. The
+// root keeps its page, so that nothing holding the table's root page number
+// has to change.
+func (t *Table) loadRows(next func() (*Row, error), fill float64) (int, error) {
+	oldPages, err := t.pager.treePages(t.rootPageNum)
+	if err != nil {
+		return 0, err
+	}
+	cursor, err := t.tableStart()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	var current Row
+	var loaded *Row
+	done := false
+	merged := func() (*Row, error) {
+		if loaded == nil && !done {
+			var err error
+			if loaded, err = next(); err != nil {
+				return nil, err
+			} else if loaded == nil {
+				done = true
+			} else {
+				n++
+			}
+		}
+		if !cursor.endOfTable {
+			value, err := cursor.cursorValue()
+			if err != nil {
+				return nil, err
+			}
+			current.deSerializeRow(unsafe.Pointer(value))
+			if loaded != nil && loaded.id == current.id {
+				return nil, fmt.Errorf("%w %d", ErrDuplicateKey, current.id)
+			}
+			if loaded == nil || current.id < loaded.id {
+				return &current, cursor.advance()
+			}
+		}
+		row := loaded
+		loaded = nil
+		return row, nil
+	}
+	root, err := t.pager.buildTable(merged, fill)
+	if err != nil {
+		return 0, err
+	}
+	if err := t.pager.moveRoot(root, t.rootPageNum); err != nil {
+		return 0, err
+	}
+	for _, pageNum := range oldPages {
+		if err := t.pager.freePage(pageNum); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// treePages returns the pages of the rows tree under the one at pageNum.
+func (p *Pager) treePages(pageNum uint32_t) ([]uint32_t, error) {
+	header, body, err := p.getPage(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	if header.pageType != PageInternal {
+		return nil, nil
+	}
+	page := InternalPage{header: header, body: (*InternalPageBody)(body)}
+	_, children := page.internalNodeEntries()
+	var pages []uint32_t
+	for _, child := range children {
+		under, err := p.treePages(child)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(append(pages, child), under...)
+	}
+	return pages, nil
+}
+
+// moveRoot moves the root node of a rows tree from page from to page to,
+// freeing page from.
+func (p *Pager) moveRoot(from, to uint32_t) error {
+	fromHeader, fromBody, err := p.getPage(from)
+	if err != nil {
+		return err
+	}
+	header, body, err := p.getPage(to)
+	if err != nil {
+		return err
+	}
+	*header = *fromHeader
+	*(*[PageBodySize]byte)(body) = *(*[PageBodySize]byte)(fromBody)
+	p.markDirty(to)
+	if header.pageType == PageInternal {
+		page := InternalPage{header: header, body: (*InternalPageBody)(body)}
+		_, children := page.internalNodeEntries()
+		for _, child := range children {
+			childHeader, _, err := p.getPage(child)
+			if err != nil {
+				return err
+			}
+			childHeader.parentPointer = to
+			p.markDirty(child)
+		}
+	}
+	return p.freePage(from)
+}
+
+// rowSorter sorts rows by id for Load: up to loadRunRows of them in memory,
+// more in sorted runs written to temporary files and merged as they are read
+// back.
+type rowSorter struct {
+	rows []Row
+	runs []*os.File
+}
+
+func (s *rowSorter) add(row *Row) error {
+	s.rows = append(s.rows, *row)
+	if len(s.rows) == loadRunRows {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *rowSorter) sort() {
+	sort.Slice(s.rows, func(i, j int) bool { return s.rows[i].id < s.rows[j].id })
+}
+
+// spill writes the rows in memory to a new run.
+func (s *rowSorter) spill() error {
+	s.sort()
+	f, err := os.CreateTemp("", "db_tutorial-load-*")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, f)
+	w := bufio.NewWriter(f)
+	var buf [RowSize]byte
+	for i := range s.rows {
+		s.rows[i].serializeRow(unsafe.Pointer(&buf))
+		if _, err := w.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	s.rows = s.rows[:0]
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+// sorted returns the rows added in id order, one at a time until it returns
+// nil.
+func (s *rowSorter) sorted() (func() (*Row, error), error) {
+	if len(s.runs) == 0 {
+		s.sort()
+		i := 0
+		return func() (*Row, error) {
+			if i == len(s.rows) {
+				return nil, nil
+			}
+			i++
+			return &s.rows[i-1], nil
+		}, nil
+	}
+	if len(s.rows) > 0 {
+		if err := s.spill(); err != nil {
+			return nil, err
+		}
+	}
+	var heads []*sortedRun
+	for _, f := range s.runs {
+		run := &sortedRun{r: bufio.NewReader(f)}
+		if ok, err := run.read(); err != nil {
+			return nil, err
+		} else if ok {
+			heads = append(heads, run)
+		}
+	}
+	var row Row
+	return func() (*Row, error) {
+		if len(heads) == 0 {
+			return nil, nil
+		}
+		least := 0
+		for i, run := range heads {
+			if run.row.id < heads[least].row.id {
+				least = i
+			}
+		}
+		row = heads[least].row
+		if ok, err := heads[least].read(); err != nil {
+			return nil, err
+		} else if !ok {
+			heads = append(heads[:least], heads[least+1:]...)
+		}
+		return &row, nil
+	}, nil
+}
+
+// close removes the runs.
+func (s *rowSorter) close() {
+	for _, f := range s.runs {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	s.runs = nil
+}
+
+// sortedRun reads back a run of rowSorter, row holding the next one.
+type sortedRun struct {
+	r   *bufio.Reader
+	row Row
+}
+
+func (run *sortedRun) read() (bool, error) {
+	var buf [RowSize]byte
+	if _, err := io.ReadFull(run.r, buf[:]); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	run.row.deSerializeRow(unsafe.Pointer(&buf))
+	return true, nil
+}
+
+// loadRecords loads the records read from r, in the format importRows takes,
+// into the table as Load does, sorting them first. A record that does not make
+// a valid row is left out and returned with the line it is on.
+func loadRecords(table *Table, r io.Reader, format string, fill float64) (loaded int, rejected []rejectedRow, err error) {
+	sorter := new(rowSorter)
+	defer sorter.close()
+	reject := func(line int, reason string) {
+		rejected = append(rejected, rejectedRow{line: line, reason: reason})
+	}
+	add := func(line int, values []string) error {
+		row, reason := rowFromValues(values)
+		if reason != "" {
+			reject(line, reason)
+			return nil
+		}
+		return sorter.add(&row)
+	}
+	if format == "json" {
+		err = readJSONLines(r, add, reject)
+	} else {
+		err = readCSV(r, add, reject)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	source, err := sorter.sorted()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if err := table.pager.reserve(); err != nil {
+		return 0, nil, err
+	}
+	view := &Table{rootPageNum: table.rootPageNum, pager: table.pager.writer(false)}
+	if loaded, err = view.loadRows(source, fill); err != nil {
+		view.pager.rollback()
+		return 0, nil, err
+	}
+	view.pager.commit()
+	return loaded, rejected, nil
+}
@@ -0,0 +1,249 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// rowsOf returns a function handing out rows with the ids given, for Load.
+func rowsOf(t *testing.T, ids []int) func() (Row, error) {
+	return func() (Row, error) {
+		if len(ids) == 0 {
+			return Row{}, io.EOF
+		}
+		id := ids[0]
+		ids = ids[1:]
+		row, err := NewRow(uint32(id), fmt.Sprintf("user%d", id), fmt.Sprintf("user%d@example.com", id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return row, nil
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, id := range []int{5, 100, 300} {
+		if err := db.Exec(fmt.Sprintf("insert %d u e", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ids []int
+	for id := 1; id <= 400; id++ {
+		if id != 5 && id != 100 && id != 300 {
+			ids = append(ids, id)
+		}
+	}
+	rand.New(rand.NewSource(1)).Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	n, err := db.Load(rowsOf(t, ids), &LoadOptions{FillFactor: 0.5})
+	if err != nil || n != 397 {
+		t.Fatalf("Load = %d, %v", n, err)
+	}
+	if got := scan(t, db); got != 400 {
+		t.Errorf("%d rows after loading, want 400", got)
+	}
+	if row, err := db.Get(123); err != nil || row.Username() != "user123" {
+		t.Errorf("Get(123) = %q, %v", row.Username(), err)
+	}
+
+	// half full leaves, which take inserts without splitting
+	pages := func() uint32_t {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return db.table.pager.numPages
+	}
+	before := pages()
+	if err := db.Exec("insert 401 u e"); err != nil {
+		t.Fatal(err)
+	}
+	if after := pages(); after != before {
+		t.Errorf("insert after the last loaded row grew the file from %d to %d pages", before, after)
+	}
+
+	if _, err := db.Load(rowsOf(t, []int{500, 7}), nil); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("loading a taken id: %v", err)
+	}
+	if _, err := db.Load(rowsOf(t, []int{600, 501}), &LoadOptions{Sorted: true}); err == nil || !strings.Contains(err.Error(), "out of order") {
+		t.Errorf("loading unsorted rows as sorted: %v", err)
+	}
+	if _, err := db.Load(rowsOf(t, nil), &LoadOptions{FillFactor: 1.5}); err == nil {
+		t.Error("Load took a fill factor of 1.5")
+	}
+	if _, err := db.Get(500); err != ErrNotFound {
+		t.Errorf("Get(500) after failed loads: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := scan(t, db); got != 401 {
+		t.Errorf("%d rows after reopening, want 401", got)
+	}
+}
+
+func TestLoadReusesFreePages(t *testing.T) {
+	db, err := Open(MemoryPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var ids []int
+	for id := 1; id <= 200; id++ {
+		ids = append(ids, id)
+	}
+	if _, err := db.Load(rowsOf(t, ids), nil); err != nil {
+		t.Fatal(err)
+	}
+	// each load needs room for the new tree besides the old one, which it
+	// then frees for the next load, so the file stays at about two trees
+	for id := 201; id <= 210; id++ {
+		if _, err := db.Load(rowsOf(t, []int{id}), nil); err != nil {
+			t.Fatal(err)
+		}
+		pages, err := db.table.pager.treePages(db.table.rootPageNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, limit := db.table.pager.numPages, 2*uint32_t(len(pages)+2); got > limit {
+			t.Fatalf("load %d: file of %d pages for a tree of %d", id-200, got, len(pages)+1)
+		}
+	}
+	checkTree(t, db.table.pager, db.table.rootPageNum)
+	if got := scan(t, db); got != 210 {
+		t.Errorf("%d rows after loading, want 210", got)
+	}
+}
+
+func TestRowSorterRuns(t *testing.T) {
+	ids := rand.New(rand.NewSource(1)).Perm(2*loadRunRows + 10)
+	sorter := new(rowSorter)
+	defer sorter.close()
+	for _, id := range ids {
+		row := Row{id: uint32_t(id)}
+		if err := sorter.add(&row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next, err := sorter.sorted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sorter.runs) != 3 {
+		t.Errorf("%d runs, want 3", len(sorter.runs))
+	}
+	for want := 0; ; want++ {
+		row, err := next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row == nil {
+			if want != len(ids) {
+				t.Errorf("%d rows back, want %d", want, len(ids))
+			}
+			break
+		}
+		if row.id != uint32_t(want) {
+			t.Fatalf("row %d has id %d", want, row.id)
+		}
+	}
+	runs := sorter.runs
+	sorter.close()
+	for _, f := range runs {
+		if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+			t.Errorf("run %s left behind", f.Name())
+		}
+	}
+}
+
+func TestShellLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	data := filepath.Join(dir, "users.csv")
+	text := "id,username,email\n3,c,c@example.com\n1,a,a@example.com\n-2,b,b@example.com\n2,b,b@example.com\n"
+	if err := os.WriteFile(data, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var code int
+	out := captureStdout(t, func() {
+		input := strings.NewReader(".load " + data + " users 2\n.load " + data + " users 0.5\nselect;\n.load " + data + " users\n")
+		code = RunShell(path, &ShellOptions{Input: input, Prompt: true})
+	})
+	for _, want := range []string{
+		"Usage: .load FILE TABLE [FILLFACTOR]\n",
+		data + ":4: id must be positive\nLoaded 3 rows, rejected 1.\n",
+		"(1, a, a@example.com)\n(2, b, b@example.com)\n(3, c, c@example.com)\n",
+		"Error: db: duplicate key 1, nothing loaded.\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not hold %q:\n%s", want, out)
+		}
+	}
+	if code != ExitSuccess {
+		t.Errorf("exit code %d", code)
+	}
+}
+
+// checkTree checks that every leaf of the rows tree under pageNum is at the
+// same depth and every internal node has two children or more, and returns
+// the depth.
+func checkTree(t *testing.T, p *Pager, pageNum uint32_t) int {
+	t.Helper()
+	header, body, err := p.getPage(pageNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.pageType != PageInternal {
+		return 0
+	}
+	_, children := (&InternalPage{header: header, body: (*InternalPageBody)(body)}).internalNodeEntries()
+	if len(children) < 2 {
+		t.Errorf("internal page %d has %d children", pageNum, len(children))
+	}
+	depth := -1
+	for _, child := range children {
+		d := checkTree(t, p, child)
+		if depth >= 0 && d != depth {
+			t.Errorf("children of page %d are %d and %d deep", pageNum, depth, d)
+		}
+		depth = d
+	}
+	return depth + 1
+}
+
+func TestLoadShape(t *testing.T) {
+	for _, fill := range []float64{0.1, 0.5, 0.6, 0.75, 1} {
+		for _, count := range []int{0, 1, 4, 5, 10, 17, 100} {
+			db, err := Open(MemoryPath, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]int, count)
+			for i := range ids {
+				ids[i] = i + 1
+			}
+			if _, err := db.Load(rowsOf(t, ids), &LoadOptions{FillFactor: fill, Sorted: true}); err != nil {
+				t.Fatal(err)
+			}
+			checkTree(t, db.table.pager, db.table.rootPageNum)
+			if got := scan(t, db); got != count {
+				t.Errorf("fill %v: %d rows, want %d", fill, got, count)
+			}
+			db.Close()
+		}
+	}
+}
@@ -0,0 +1,584 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// valueFor is what the stress tests store under key, so readers can check
+// every pair they see without knowing what the writers have done so far.
+func valueFor(key []byte, round int) []byte {
+	return bytes.Repeat(append(key, byte(round)), 1+round%40)
+}
+
+func checkPair(key, value []byte) error {
+	if len(value) == 0 || len(value)%(len(key)+1) != 0 {
+		return fmt.Errorf("value of %q has length %d", key, len(value))
+	}
+	round := int(value[len(key)])
+	if !bytes.Equal(value, valueFor(key, round)) {
+		return fmt.Errorf("value of %q is torn", key)
+	}
+	return nil
+}
+
+func TestConcurrentReadersAndWriters(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	bucket, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, readers, rounds, keysPerWriter = 4, 4, 10, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers+readers)
+	done := make(chan struct{})
+
+	var writersWG sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		writersWG.Add(1)
+		go func(w int) {
+			defer writersWG.Done()
+			for round := 0; round < rounds; round++ {
+				for k := 0; k < keysPerWriter; k++ {
+					key := []byte(fmt.Sprintf("w%d-k%03d", w, k))
+					var err error
+					if (round+k)%5 == 0 {
+						err = bucket.Delete(key)
+						if errors.Is(err, ErrNotFound) {
+							err = nil
+						}
+					} else {
+						err = bucket.Put(key, valueFor(key, round))
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+				id := w*rounds + round
+				if err := db.Exec(fmt.Sprintf("insert %d w%d mail", id, w)); err != nil && !errors.Is(err, ErrTableFull) {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var previous []byte
+				err := bucket.ForEach(func(key, value []byte) error {
+					if previous != nil && bytes.Compare(previous, key) >= 0 {
+						return fmt.Errorf("keys out of order: %q before %q", previous, key)
+					}
+					previous = key
+					return checkPair(key, value)
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+				key := []byte(fmt.Sprintf("w%d-k%03d", r%writers, r))
+				if value, err := bucket.Get(key); err == nil {
+					err = checkPair(key, value)
+					if err != nil {
+						errs <- err
+						return
+					}
+				} else if !errors.Is(err, ErrNotFound) {
+					errs <- err
+					return
+				}
+
+				rows, err := db.Query("select")
+				if err != nil {
+					errs <- err
+					return
+				}
+				last := int64(-1)
+				for rows.Next() {
+					id := int64(rows.Row().ID())
+					if id <= last {
+						errs <- fmt.Errorf("row %d after row %d", id, last)
+						return
+					}
+					last = id
+				}
+				if err := rows.Err(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(r)
+	}
+
+	writersWG.Wait()
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for w := 0; w < writers; w++ {
+		for k := 0; k < keysPerWriter; k++ {
+			key := []byte(fmt.Sprintf("w%d-k%03d", w, k))
+			value, err := bucket.Get(key)
+			if (rounds-1+k)%5 == 0 {
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("%s: err = %v, want ErrNotFound", key, err)
+				}
+			} else if err != nil || !bytes.Equal(value, valueFor(key, rounds-1)) {
+				t.Errorf("%s: got %d bytes, err = %v", key, len(value), err)
+			}
+		}
+	}
+}
+
+func TestConcurrentTransactionsAreIsolated(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	const writers, readers, rounds = 4, 4, 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers+readers)
+	done := make(chan struct{})
+
+	var writersWG sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		writersWG.Add(1)
+		go func(w int) {
+			defer writersWG.Done()
+			for round := 0; round < rounds; round++ {
+				tx, err := db.Begin()
+				if err != nil {
+					errs <- err
+					return
+				}
+				// even rounds are rolled back, readers must never see their keys
+				prefix := "committed"
+				if round%2 == 0 {
+					prefix = "pending"
+				}
+				bucket, err := tx.KV()
+				for i := 0; err == nil && i < 10; i++ {
+					err = bucket.Put([]byte(fmt.Sprintf("%s-%d-%d-%d", prefix, w, round, i)), []byte("x"))
+				}
+				if err != nil {
+					tx.Rollback()
+					errs <- err
+					return
+				}
+				if round%2 == 0 {
+					err = tx.Rollback()
+				} else {
+					err = tx.Commit()
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bucket, err := db.KV()
+			if err != nil {
+				errs <- err
+				return
+			}
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				err := bucket.Prefix([]byte("pending-"), func(key, value []byte) error {
+					return fmt.Errorf("reader saw uncommitted key %q", key)
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	writersWG.Wait()
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	bucket, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	if err := bucket.Prefix([]byte("committed-"), func(key, value []byte) error {
+		count++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := writers * rounds / 2 * 10; count != want {
+		t.Errorf("got %d committed keys, want %d", count, want)
+	}
+}
+
+func TestConcurrentCursorsDuringInserts(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for _, id := range []int{5, 1, 9, 3, 7, 2, 8, 4, 6} {
+			if err := db.Exec(fmt.Sprintf("insert %d user mail", id)); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			cursor, err := db.Cursor()
+			if err != nil {
+				errs <- err
+				return
+			}
+			last := uint32(1 << 31)
+			for ok := cursor.Last(); ok; ok = cursor.Prev() {
+				if id := cursor.Row().ID(); id >= last {
+					errs <- fmt.Errorf("row %d after row %d walking backwards", id, last)
+					return
+				} else {
+					last = id
+				}
+			}
+			if err := cursor.Err(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestReadTransactionSeesSnapshot(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	bucket, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 200
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("old-%03d", i))
+		if err := bucket.Put(key, valueFor(key, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, err := db.BeginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// delete everything so its pages are freed and reused by the new keys
+	for i := 0; i < n; i++ {
+		if err := bucket.Delete([]byte(fmt.Sprintf("old-%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("new-%03d", i))
+		if err := bucket.Put(key, valueFor(key, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Exec("insert 1 user mail"); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := tx.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	if err := snapshot.ForEach(func(key, value []byte) error {
+		if !bytes.HasPrefix(key, []byte("old-")) {
+			return fmt.Errorf("snapshot saw later key %q", key)
+		}
+		count++
+		return checkPair(key, value)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Errorf("snapshot has %d keys, want %d", count, n)
+	}
+	rows, err := tx.Query("select")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows.Next() {
+		t.Errorf("snapshot saw later row %d", rows.Row().ID())
+	}
+	if err := tx.Exec("insert 2 user mail"); !errors.Is(err, ErrTxReadOnly) {
+		t.Errorf("Exec: err = %v, want ErrTxReadOnly", err)
+	}
+	if err := snapshot.Put([]byte("k"), []byte("v")); !errors.Is(err, ErrTxReadOnly) {
+		t.Errorf("Put: err = %v, want ErrTxReadOnly", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bucket.Get([]byte("old-000")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get: err = %v, want ErrNotFound", err)
+	}
+	if p := db.table.pager; len(p.readers) != 0 || len(p.history) != 0 {
+		t.Errorf("%d snapshots and %d page histories left after the last reader", len(p.readers), len(p.history))
+	}
+}
+
+func TestScanDoesNotBlockWriters(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	for id := 1; id <= 3; id++ {
+		if err := db.Exec(fmt.Sprintf("insert %d user mail", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := db.Query("select")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rows.Next() {
+		t.Fatal(rows.Err())
+	}
+	for id := 4; id <= 6; id++ {
+		if err := db.Exec(fmt.Sprintf("insert %d user mail", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := 1
+	for rows.Next() {
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("scan saw %d rows, want the 3 there were when it started", count)
+	}
+	if p := db.table.pager; len(p.readers) != 0 || len(p.history) != 0 {
+		t.Errorf("%d snapshots and %d page histories left after the scan", len(p.readers), len(p.history))
+	}
+}
+
+func TestSharedInsertsIntoDifferentLeaves(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	for id := 10; id <= 200; id += 10 {
+		if err := db.Exec(fmt.Sprintf("insert %d user mail", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// both stay open at once, which a single writer lock would not allow
+	var txs []*Tx
+	for _, id := range []int{15, 105} {
+		tx, err := db.begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := executeStatement(&Statement{sType: StatementInsert, rowToInsert: Row{id: uint32_t(id)}}, tx.table); err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+	for _, tx := range txs {
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []uint32{15, 105} {
+		if _, err := db.Get(id); err != nil {
+			t.Errorf("Get(%d): %v", id, err)
+		}
+	}
+}
+
+func TestSharedInsertRollbackFreesPages(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	// eight half full leaves under internal nodes with room for more
+	perLeaf := int(LeafNodeMaxCells+1) / 2
+	var ids []int
+	for i := 1; i <= 8*perLeaf; i++ {
+		ids = append(ids, i*100)
+	}
+	if _, err := db.Load(rowsOf(t, ids), &LoadOptions{FillFactor: 0.5, Sorted: true}); err != nil {
+		t.Fatal(err)
+	}
+	// fill the first and the last leaf, so the next insert into each splits
+	last := ids[len(ids)-1]
+	for i := 1; i <= int(LeafNodeMaxCells)-perLeaf; i++ {
+		for _, id := range []int{100 + i, last + i} {
+			if err := db.Exec(fmt.Sprintf("insert %d user mail", id)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	free := freePages(t, db)
+	var txs []*Tx
+	for _, id := range []int{150, last + 50} {
+		tx, err := db.begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := executeStatement(&Statement{sType: StatementInsert, rowToInsert: Row{id: uint32_t(id)}}, tx.table); err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+	// the first split's page is not the last one any more
+	if err := txs[0].Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := txs[1].Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := freePages(t, db); n != free+1 {
+		t.Errorf("%d pages on the freelist after the rollback, want %d", n, free+1)
+	}
+	checkTree(t, db.table.pager, db.table.rootPageNum)
+	if _, err := db.Get(150); err != ErrNotFound {
+		t.Errorf("Get(150) after the rollback: %v", err)
+	}
+	if _, err := db.Get(uint32(last + 50)); err != nil {
+		t.Errorf("Get(%d): %v", last+50, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentInserts(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+
+	const goroutines, perGoroutine = 8, 250
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < perGoroutine; i++ {
+				id := i*goroutines + g + 1
+				if err := db.Exec(fmt.Sprintf("insert %d user%d mail", id, g)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query("select")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := uint32(1)
+	for rows.Next() {
+		if id := rows.Row().ID(); id != want {
+			t.Fatalf("got row %d, want %d", id, want)
+		}
+		want++
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want != goroutines*perGoroutine+1 {
+		t.Fatalf("got %d rows, want %d", want-1, goroutines*perGoroutine)
+	}
+}
+
+func BenchmarkConcurrentInsert(b *testing.B) {
+	for _, goroutines := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("goroutines=%d", goroutines), func(b *testing.B) {
+			db, err := Open(filepath.Join(b.TempDir(), "bench.db"), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			var next uint32
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						n := atomic.AddUint32(&next, 1)
+						if n > uint32(b.N) {
+							return
+						}
+						// an odd multiplier spreads consecutive inserts over distinct leaves
+						id := n * 2654435761
+						if err := db.Exec(fmt.Sprintf("insert %d user mail", id)); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"unsafe"
+)
+
+// Cursor returns a cursor over the table's rows in id order. It is not
+// positioned on a row until First, Last or Seek is called.
+//
+// Each move is made in a fresh snapshot, so a cursor that is not bound to a
+// transaction sees rows committed while it moves. Next and Prev step from the
+// leaf the cursor's row was read from while the row is still there, and find
+// it again from the root once commits have moved it.
+func (db *DB) Cursor() (*Cursor, error) {
+	return db.cursor(nil)
+}
+
+// Cursor returns a cursor over the table's rows as seen by the transaction.
+func (tx *Tx) Cursor() (*Cursor, error) {
+	return tx.db.cursor(tx)
+}
+
+func (db *DB) cursor(tx *Tx) (*Cursor, error) {
+	if err := db.view(tx, func(t *Table) error { return nil }); err != nil {
+		return nil, err
+	}
+	return &Cursor{db: db, tx: tx, endOfTable: true}, nil
+}
+
+// First moves the cursor to the row with the smallest id. It returns false if
+// the table is empty.
+func (c *Cursor) First() bool {
+	return c.position(func(t *Table) (*Cursor, error) {
+		return t.tableStart()
+	})
+}
+
+// Last moves the cursor to the row with the largest id. It returns false if
+// the table is empty.
+func (c *Cursor) Last() bool {
+	return c.position(func(t *Table) (*Cursor, error) {
+		return t.tableEnd()
+	})
+}
+
+// Seek moves the cursor to the row with the given id, or to the next row after
+// it if it does not exist. It returns false if there is no such row.
+func (c *Cursor) Seek(id uint32) bool {
+	return c.position(func(t *Table) (*Cursor, error) {
+		return t.seek(uint32_t(id))
+	})
+}
+
+// Next moves the cursor to the next row. It returns false at the end of the
+// table, after which the cursor must be repositioned with First, Last or Seek.
+func (c *Cursor) Next() bool {
+	if c.endOfTable || c.err != nil {
+		return false
+	}
+	if c.row.id == math.MaxUint32 {
+		c.endOfTable = true
+		return false
+	}
+	return c.position(func(t *Table) (*Cursor, error) {
+		cursor, err := c.place(t)
+		if err != nil {
+			return nil, err
+		} else if cursor == nil {
+			return t.seek(c.row.id + 1)
+		}
+		cursor.cellNum++
+		return cursor, cursor.skipEmptyLeaf()
+	})
+}
+
+// Prev moves the cursor to the previous row. It returns false at the start of
+// the table, after which the cursor must be repositioned with First, Last or
+// Seek.
+func (c *Cursor) Prev() bool {
+	if c.endOfTable || c.err != nil {
+		return false
+	}
+	return c.position(func(t *Table) (*Cursor, error) {
+		cursor, err := c.place(t)
+		if err == nil && cursor == nil {
+			cursor, err = t.find(c.row.id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return cursor, cursor.retreat()
+	})
+}
+
+// place returns a cursor on the cursor's row in the leaf it was read from, or
+// nil if the row is no longer there.
+func (c *Cursor) place(t *Table) (*Cursor, error) {
+	if c.generation != t.pager.pageGeneration() {
+		return nil, nil // a vacuum moved every page
+	}
+	header, body, err := t.pager.getPage(c.pageNum)
+	if err != nil {
+		return nil, err
+	}
+	leafPage := LeafPage{header: header, body: (*LeafPageBody)(body)}
+	if header.pageType != PageLeaf || c.cellNum >= header.numCells || *leafPage.leafNodeKey(c.cellNum) != c.row.id {
+		return nil, nil
+	}
+	return &Cursor{table: t, pageNum: c.pageNum, cellNum: c.cellNum}, nil
+}
+
+// Row returns the row the cursor is positioned on.
+func (c *Cursor) Row() Row {
+	if c.endOfTable {
+		return Row{}
+	}
+	return c.row
+}
+
+// Err returns the error, if any, that stopped the cursor.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// position moves the cursor to the row locate finds and reads it.
+func (c *Cursor) position(locate func(t *Table) (*Cursor, error)) bool {
+	c.err = c.db.view(c.tx, func(t *Table) error {
+		cursor, err := locate(t)
+		if err != nil {
+			return err
+		}
+		c.endOfTable = cursor.endOfTable
+		if c.endOfTable {
+			return nil
+		}
+		c.pageNum, c.cellNum = cursor.pageNum, cursor.cellNum
+		c.generation = t.pager.pageGeneration()
+		value, err := cursor.cursorValue()
+		if err != nil {
+			return err
+		}
+		c.row.deSerializeRow(unsafe.Pointer(value))
+		return nil
+	})
+	if c.err != nil {
+		c.endOfTable = true
+	}
+	return !c.endOfTable
+}
+
+// seek returns a cursor on the row with the given key or the next one after it.
+func (t *Table) seek(key uint32_t) (*Cursor, error) {
+	cursor, err := t.find(key)
+	if err != nil {
+		return nil, err
+	}
+	return cursor, cursor.skipEmptyLeaf()
+}
+
+// skipEmptyLeaf moves a cursor that points one past the last cell of a leaf to
+// the first cell of the next leaf that has one.
+func (c *Cursor) skipEmptyLeaf() error {
+	for hops := uint32_t(0); ; hops++ {
+		header, body, err := c.table.pager.getPage(c.pageNum)
+		if err != nil {
+			return err
+		}
+		if c.cellNum < header.numCells {
+			return nil
+		}
+		leafPage := LeafPage{header: header, body: (*LeafPageBody)(body)}
+		nextPageNum := *leafPage.leafNodeNextLeaf()
+		if nextPageNum == 0 {
+			c.endOfTable = true
+			return nil
+		}
+		if hops == TableMaxPages {
+			return fmt.Errorf("%w: leaf %d links back into its own chain", ErrCorrupt, nextPageNum)
+		}
+		c.pageNum = nextPageNum
+		c.cellNum = 0
+	}
+}
+
+// retreat moves the cursor to the cell before it, in the previous leaf that
+// has one if it is on the first.
+func (c *Cursor) retreat() error {
+	if c.cellNum > 0 {
+		c.cellNum -= 1
+		return nil
+	}
+	for hops := uint32_t(0); ; hops++ {
+		header, body, err := c.table.pager.getPage(c.pageNum)
+		if err != nil {
+			return err
+		}
+		leafPage := LeafPage{header: header, body: (*LeafPageBody)(body)}
+		prevPageNum := *leafPage.leafNodePrevLeaf()
+		if prevPageNum == 0 {
+			c.endOfTable = true
+			return nil
+		}
+		if hops == TableMaxPages {
+			return fmt.Errorf("%w: leaf %d links back into its own chain", ErrCorrupt, prevPageNum)
+		}
+		prevHeader, _, err := c.table.pager.getPage(prevPageNum)
+		if err != nil {
+			return err
+		}
+		c.pageNum = prevPageNum
+		if prevHeader.numCells > 0 {
+			c.cellNum = prevHeader.numCells - 1
+			return nil
+		}
+	}
+}
+
+// tableEnd returns a cursor on the last row, following right children down
+// from the root.
+func (t *Table) tableEnd() (*Cursor, error) {
+	pageNum := t.rootPageNum
+	for {
+		header, body, err := t.pager.getPage(pageNum)
+		if err != nil {
+			return nil, err
+		}
+		if header.pageType == PageLeaf {
+			cursor := &Cursor{table: t, pageNum: pageNum}
+			if header.numCells == 0 {
+				cursor.endOfTable = true
+			} else {
+				cursor.cellNum = header.numCells - 1
+			}
+			return cursor, nil
+		}
+		internalPage := InternalPage{header: header, body: (*InternalPageBody)(body)}
+		pageNum = *internalPage.internalNodeRightChild()
+	}
+}
@@ -0,0 +1,239 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+// openEvenDB returns a database holding the rows with ids 2, 4, ... 2n.
+func openEvenDB(t *testing.T, n int) *DB {
+	t.Helper()
+	db := openTestDB(t)
+	for i := n; i >= 1; i-- {
+		if err := db.Exec(fmt.Sprintf("insert %d user%d user%d@example.com", 2*i, i, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestCursorSeek(t *testing.T) {
+	const n = 100
+	db := openEvenDB(t, n)
+	defer db.Close()
+	cursor, err := db.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		id   uint32
+		ok   bool
+		want uint32
+	}{
+		{"before the first", 0, true, 2},
+		{"first", 2, true, 2},
+		{"absent", 3, true, 4},
+		{"present", 50, true, 50},
+		{"last", 2 * n, true, 2 * n},
+		{"past the end", 2*n + 1, false, 0},
+	}
+	for _, test := range tests {
+		ok := cursor.Seek(test.id)
+		if ok != test.ok {
+			t.Errorf("%s: Seek(%d) = %v, want %v", test.name, test.id, ok, test.ok)
+			continue
+		}
+		if ok && cursor.Row().ID() != test.want {
+			t.Errorf("%s: Seek(%d) found %d, want %d", test.name, test.id, cursor.Row().ID(), test.want)
+		}
+	}
+	// every gap, including those between the last row of a leaf and the first
+	// of the next
+	for id := uint32(1); id < 2*n; id += 2 {
+		if !cursor.Seek(id) || cursor.Row().ID() != id+1 {
+			t.Errorf("Seek(%d) did not find %d", id, id+1)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCursorWalk(t *testing.T) {
+	const n = 100
+	db := openEvenDB(t, n)
+	defer db.Close()
+	header, _, err := db.table.pager.getPage(db.table.rootPageNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.pageType != PageInternal {
+		t.Fatal("rows fit in one leaf, nothing to walk across")
+	}
+	cursor, err := db.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		start func() bool
+		move  func() bool
+		step  int
+	}{
+		{"forward", cursor.First, cursor.Next, 2},
+		{"backward", cursor.Last, cursor.Prev, -2},
+	}
+	for _, test := range tests {
+		var want uint32 = 2
+		if test.step < 0 {
+			want = 2 * n
+		}
+		count := 0
+		for ok := test.start(); ok; ok = test.move() {
+			if id := cursor.Row().ID(); id != want {
+				t.Fatalf("%s: row %d has id %d, want %d", test.name, count, id, want)
+			}
+			want = uint32(int(want) + test.step)
+			count++
+		}
+		if err := cursor.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if count != n {
+			t.Errorf("%s: walked %d rows, want %d", test.name, count, n)
+		}
+	}
+}
+
+func TestCursorEmptyTable(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	cursor, err := db.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		move func() bool
+	}{
+		{"First", cursor.First},
+		{"Last", cursor.Last},
+		{"Seek", func() bool { return cursor.Seek(1) }},
+	}
+	for _, test := range tests {
+		if test.move() {
+			t.Errorf("%s found row %d in an empty table", test.name, cursor.Row().ID())
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCursorStepsAlongLeaves(t *testing.T) {
+	const n = 100
+	db := openEvenDB(t, n)
+	defer db.Close()
+	cursor, err := db.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cursor.First() {
+		t.Fatal(cursor.Err())
+	}
+	// steps follow the links between leaves and never come down from the
+	// root, which is of no use to them while it is broken
+	root, _, err := db.table.pager.getPage(db.table.rootPageNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := *root
+	root.pageType = PageFree
+	count := 1
+	for cursor.Next() {
+		count++
+	}
+	for cursor.Last(); cursor.Prev(); {
+		count--
+	}
+	*root = saved
+	if err := cursor.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("walked %d rows forward and back to %d, want %d and 1", n, count, n)
+	}
+}
+
+func TestCursorAfterCommits(t *testing.T) {
+	const n = 100
+	db := openEvenDB(t, n)
+	defer db.Close()
+	cursor, err := db.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the odd rows inserted as the cursor goes split the leaves under it
+	var ids []uint32
+	for ok := cursor.First(); ok; ok = cursor.Next() {
+		id := cursor.Row().ID()
+		ids = append(ids, id)
+		if id%2 == 0 && id < 2*n {
+			if err := db.Exec(fmt.Sprintf("insert %d odd odd@example.com", id+1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		if id != uint32(i+2) {
+			t.Fatalf("row %d has id %d, want %d", i, id, i+2)
+		}
+	}
+	if len(ids) != 2*n-1 {
+		t.Errorf("walked %d rows, want %d", len(ids), 2*n-1)
+	}
+}
+
+func TestCursorSkipsEmptyLeaves(t *testing.T) {
+	db := openEvenDB(t, 100)
+	defer db.Close()
+	p := db.table.pager
+	// the second leaf, emptied
+	first, err := db.table.tableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstHeader, body, err := p.getPage(first.pageNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastOfFirst := (*LeafPageBody)(body).cells[firstHeader.numCells-1].key
+	second := (*LeafPageBody)(body).nextLeaf
+	header, body, err := p.getPage(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, thirdBody, err := p.getPage((*LeafPageBody)(body).nextLeaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstOfThird := (*LeafPageBody)(thirdBody).cells[0].key
+	saved := header.numCells
+	header.numCells = 0
+	defer func() { header.numCells = saved }()
+
+	cursor, err := db.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cursor.Seek(uint32(lastOfFirst)) || !cursor.Next() || cursor.Row().ID() != uint32(firstOfThird) {
+		t.Errorf("Next from %d: at %d, want %d, err %v", lastOfFirst, cursor.Row().ID(), firstOfThird, cursor.Err())
+	}
+	if !cursor.Seek(uint32(firstOfThird)) || !cursor.Prev() || cursor.Row().ID() != uint32(lastOfFirst) {
+		t.Errorf("Prev from %d: at %d, want %d, err %v", firstOfThird, cursor.Row().ID(), lastOfFirst, cursor.Err())
+	}
+}
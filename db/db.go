@@ -0,0 +1,441 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// Options configures how Open opens a database. A nil *Options selects the
+// defaults.
+type Options struct {
+	// BusyTimeout is how long to wait for another process to release its lock
+	// on the file before failing with ErrLocked. Zero fails at once.
+	BusyTimeout time.Duration
+	// ReadOnly opens an existing file for reading only. Changes fail with
+	// ErrReadOnly and Close writes nothing back.
+	ReadOnly bool
+	// FlushInterval, if set, is how often committed changes are written back
+	// to the file in the background. Otherwise they are written by Flush and
+	// Close. Until they are, no other process can change the file, so a DB
+	// that stays open while others write should set FlushInterval or call
+	// Flush.
+	FlushInterval time.Duration
+	// Synchronous is when the file is synced, by default whenever changes
+	// are written back to it. The pragma statement changes it later:
+	//
+	//	pragma synchronous = full
+	Synchronous Synchronous
+	// MMap serves page reads from a read-only memory mapping of the file
+	// rather than reading each page into a buffer of its own. Writes still go
+	// through the file. It has no effect where files can not be mapped, nor on
+	// a database not kept in a file.
+	MMap bool
+	// PageSize, if set, is the size in bytes of the pages the database must
+	// have. A new file is created with pages of that size, and an existing one
+	// must record it in its meta page; otherwise Open fails with
+	// ErrPageSize. Only pages of PageSize bytes are supported.
+	PageSize int
+	// Storage, if set, holds the database in place of the file at path, which
+	// then only names it. No locks are taken on it.
+	Storage Storage
+}
+
+// DB is a handle to an open database file. Unlike Run, none of its methods
+// exit the process; every failure is returned as an error.
+//
+// Processes share a database file through flock based locks. Any number of
+// them can have the file open and read it, each holding a shared lock for as
+// long as a statement or transaction runs, and seeing what the others have
+// written back to it. Only one at a time may change it, from its first change
+// until the change is written back to the file; the others fail with
+// ErrLocked. Committing does not write back: that waits for Flush, Close or
+// Options.FlushInterval, and until then no other process can change the
+// file. Writing back waits for the statements and transactions of other
+// processes to end.
+//
+// A DB is safe for use by multiple goroutines. Transactions run one at a time,
+// except that inserts run by Exec go on at once when they fall into different
+// leaves, and any number of readers run alongside them. Every read sees a
+// snapshot of the database at one commit, see BeginRead.
+type DB struct {
+	table  *Table
+	mu     sync.RWMutex // held for reading by readers, for writing by Close
+	writer sync.RWMutex // held by the open transaction, shared by inserts
+	closed chan struct{}
+}
+
+// Open opens the database file at path, creating it if it does not exist
+// unless opts.ReadOnly is set. A path of MemoryPath opens a new database held
+// in memory instead, which only this DB can see.
+func Open(path string, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+	if path == "" && opts.Storage == nil {
+		return nil, fmt.Errorf("must supply a database filename")
+	}
+	table, err := dbOpen(&path, opts)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{table: table, closed: make(chan struct{})}
+	if opts.FlushInterval > 0 {
+		go db.flushEvery(opts.FlushInterval)
+	}
+	return db, nil
+}
+
+// Flush writes the changes committed so far back to the file and syncs it,
+// as Close does, so that they outlive the process. Like Close it fails with
+// ErrLocked while other processes go on reading the file.
+func (db *DB) Flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.table == nil {
+		return ErrClosed
+	}
+	return db.table.pager.writeBack()
+}
+
+// flushEvery flushes the database every interval until it is closed. A flush
+// that fails is tried again next time, the changes stay in the cache.
+func (db *DB) flushEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			db.Flush()
+		case <-db.closed:
+			return
+		}
+	}
+}
+
+// Exec runs a statement that does not return rows, such as an insert. The
+// statement runs in its own transaction, so a failed statement leaves no
+// partial changes behind. A select fails with ErrSyntax, it is run by Query.
+func (db *DB) Exec(query string) error {
+	statement, err := prepare(query)
+	if err != nil {
+		return err
+	}
+	switch statement.sType {
+	case StatementSelect:
+		return errSelectExec
+	case StatementPragma:
+		if statement.pragmaValue == "" {
+			return nil
+		}
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		if db.table == nil {
+			return ErrClosed
+		}
+		return executeStatement(statement, db.table)
+	case StatementVacuum:
+		_, err := db.Vacuum()
+		return err
+	}
+	tx, err := db.begin(statement.sType == StatementInsert)
+	if err != nil {
+		return err
+	}
+	if err := executeStatement(statement, tx.table); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Vacuum rebuilds the database with every tree packed tightly in key order,
+// as the vacuum statement does, and returns the number of bytes the file
+// shrank by. The rebuilt file replaces the old one in a single rename, so a
+// crash leaves either of them whole. It waits for the open transaction like
+// Close, and fails with ErrLocked while read transactions are open. Buckets
+// obtained before it must be obtained again.
+func (db *DB) Vacuum() (int64, error) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.table == nil {
+		return 0, ErrClosed
+	}
+	if err := db.table.lockShared(); err != nil {
+		return 0, err
+	}
+	defer db.table.pager.unlockShared()
+	return db.table.vacuum()
+}
+
+// Query runs a select statement and returns its result rows. Rows are read
+// one at a time as Next is called, all from the snapshot of the database
+// taken by Query, until they run out or are closed.
+func (db *DB) Query(query string) (*Rows, error) {
+	return db.query(nil, query)
+}
+
+func (db *DB) query(tx *Tx, query string) (*Rows, error) {
+	statement, err := prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if statement.sType != StatementSelect {
+		return nil, fmt.Errorf("%w: not a select statement", ErrSyntax)
+	}
+	var own *Tx
+	if tx == nil {
+		if own, err = db.BeginRead(); err != nil {
+			return nil, err
+		}
+		tx = own
+	}
+	cursor, err := db.cursor(tx)
+	if err != nil {
+		if own != nil {
+			own.Rollback()
+		}
+		return nil, err
+	}
+	return &Rows{cursor: cursor, tx: own}, nil
+}
+
+// Get returns the row with the given id, or ErrNotFound.
+func (db *DB) Get(id uint32) (Row, error) {
+	var row Row
+	err := db.view(nil, func(t *Table) error {
+		cursor, err := t.find(uint32_t(id))
+		if err != nil {
+			return err
+		}
+		header, body, err := t.pager.getPage(cursor.pageNum)
+		if err != nil {
+			return err
+		}
+		leafPage := LeafPage{header: header, body: (*LeafPageBody)(body)}
+		if cursor.cellNum >= *leafPage.leafNodeNumCells() || *leafPage.leafNodeKey(cursor.cellNum) != uint32_t(id) {
+			return ErrNotFound
+		}
+		row.deSerializeRow(unsafe.Pointer(leafPage.leafNodeValue(cursor.cellNum)))
+		return nil
+	})
+	return row, err
+}
+
+// Close flushes all cached pages to disk and closes the file. It waits for
+// the open transaction, if any, to finish. Read-only transactions still open
+// fail with ErrClosed from then on.
+//
+// Writing the file waits for the statements and transactions other processes
+// are running on it to end. If they do not within the busy timeout, Close
+// returns ErrLocked and the DB stays open, so that Close can be tried again.
+func (db *DB) Close() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.table == nil {
+		return ErrClosed
+	}
+	err := db.table.dbClose()
+	if errors.Is(err, ErrLocked) {
+		return err
+	}
+	db.table = nil
+	close(db.closed)
+	return err
+}
+
+// view runs fn on what tx sees of the table: the live table inside a
+// transaction that changes the database, the transaction's snapshot inside a
+// read-only one, and a snapshot taken for fn alone when tx is nil.
+func (db *DB) view(tx *Tx, fn func(t *Table) error) error {
+	if tx != nil && !tx.readOnly {
+		if tx.done {
+			return ErrTxDone
+		}
+		return fn(tx.table)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.table == nil {
+		return ErrClosed
+	}
+	if tx != nil {
+		if tx.done {
+			return ErrTxDone
+		}
+		return fn(tx.table)
+	}
+	if err := db.table.lockShared(); err != nil {
+		return err
+	}
+	defer db.table.pager.unlockShared()
+	snapshot := db.table.snapshot()
+	defer snapshot.pager.release()
+	return fn(snapshot)
+}
+
+// Rows is the result of a query. Call Next before reading each row.
+type Rows struct {
+	cursor  *Cursor
+	tx      *Tx // read-only transaction started for the rows, ended with them
+	started bool
+	closed  bool
+}
+
+// Next advances to the next row, returning false when there are no more rows
+// or an error occurred.
+func (r *Rows) Next() bool {
+	if r.closed {
+		return false
+	}
+	var ok bool
+	if !r.started {
+		r.started = true
+		ok = r.cursor.First()
+	} else {
+		ok = r.cursor.Next()
+	}
+	if !ok {
+		r.end()
+	}
+	return ok
+}
+
+// columns are the names of the columns of the rows table.
+var columns = []string{"id", "username", "email"}
+
+// Columns returns the names of the columns in the result.
+func (r *Rows) Columns() []string {
+	return append([]string(nil), columns...)
+}
+
+// Row returns the current row.
+func (r *Rows) Row() Row {
+	return r.cursor.Row()
+}
+
+// Scan copies the id, username and email of the current row into dest. Each
+// destination may be a *uint32, *int, *int64, *string or *[]byte.
+func (r *Rows) Scan(dest ...interface{}) error {
+	if r.closed {
+		return ErrClosed
+	}
+	if len(dest) != 3 {
+		return fmt.Errorf("db: expected 3 destination arguments in Scan, not %d", len(dest))
+	}
+	row := r.cursor.Row()
+	values := []interface{}{row.ID(), row.Username(), row.Email()}
+	for i, d := range dest {
+		if err := assign(d, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Err returns the error, if any, that ended the iteration.
+func (r *Rows) Err() error {
+	return r.cursor.Err()
+}
+
+// Close releases the rows. It is safe to call Close more than once.
+func (r *Rows) Close() error {
+	r.closed = true
+	r.end()
+	return nil
+}
+
+func (r *Rows) end() {
+	if r.tx != nil {
+		r.tx.Rollback()
+		r.tx = nil
+	}
+}
+
+// ID returns the row's id column.
+func (row Row) ID() uint32 {
+	return uint32(row.id)
+}
+
+// Username returns the row's username column.
+func (row Row) Username() string {
+	return cString(row.username[:])
+}
+
+// Email returns the row's email column.
+func (row Row) Email() string {
+	return cString(row.email[:])
+}
+
+// cString returns the contents of a fixed-size column up to the first NUL.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func assign(dest, value interface{}) error {
+	switch d := dest.(type) {
+	case *uint32:
+		v, ok := value.(uint32)
+		if !ok {
+			return fmt.Errorf("db: can not scan %T into %T", value, dest)
+		}
+		*d = v
+	case *int:
+		v, ok := value.(uint32)
+		if !ok {
+			return fmt.Errorf("db: can not scan %T into %T", value, dest)
+		}
+		*d = int(v)
+	case *int64:
+		v, ok := value.(uint32)
+		if !ok {
+			return fmt.Errorf("db: can not scan %T into %T", value, dest)
+		}
+		*d = int64(v)
+	case *string:
+		v, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("db: can not scan %T into %T", value, dest)
+		}
+		*d = v
+	case *[]byte:
+		v, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("db: can not scan %T into %T", value, dest)
+		}
+		*d = []byte(v)
+	default:
+		return fmt.Errorf("db: unsupported Scan destination %T", dest)
+	}
+	return nil
+}
+
+// errSelectExec is returned by Exec for a select, whose rows it would lose.
+var errSelectExec = fmt.Errorf("%w: select returns rows, use Query", ErrSyntax)
+
+// prepare parses query into a statement, turning a PrepareResult into an error.
+func prepare(query string) (*Statement, error) {
+	statement := new(Statement)
+	inputBuffer := &InputBuffer{buffer: []byte(query)}
+	switch prepareStatement(inputBuffer, statement) {
+	case PrepareSuccess:
+		return statement, nil
+	case PrepareStringTooLong:
+		return nil, fmt.Errorf("%w: string is too long", ErrSyntax)
+	case PrepareNegativeId:
+		return nil, fmt.Errorf("%w: id must be positive", ErrSyntax)
+	case PrepareUnrecognizedStatement:
+		return nil, fmt.Errorf("%w: unrecognized keyword at start of '%s'", ErrSyntax, query)
+	}
+	return nil, fmt.Errorf("%w: could not parse statement", ErrSyntax)
+}
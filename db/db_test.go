@@ -0,0 +1,161 @@
+package db
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenExecQueryClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{"insert 2 bob bob@example.com", "insert 1 alice alice@example.com"} {
+		if err := db.Exec(query); err != nil {
+			t.Fatalf("Exec(%q): %v", query, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("select")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(rows.Columns(), ","); got != "id,username,email" {
+		t.Errorf("Columns() = %s", got)
+	}
+	var got []string
+	for rows.Next() {
+		var id int
+		var username, email string
+		if err := rows.Scan(&id, &username, &email); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, strings.Join([]string{username, email}, " "))
+		if id != len(got) {
+			t.Errorf("row %d has id %d", len(got), id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "alice alice@example.com,bob bob@example.com"; strings.Join(got, ",") != want {
+		t.Errorf("rows = %q, want %s", got, want)
+	}
+	rows.Close()
+	if err := rows.Scan(new(int), new(string), new(string)); !errors.Is(err, ErrClosed) {
+		t.Errorf("Scan after Close: err = %v, want ErrClosed", err)
+	}
+
+	row, err := db.Get(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.Username() != "bob" || row.Email() != "bob@example.com" {
+		t.Errorf("Get(2) = %d %s %s", row.ID(), row.Username(), row.Email())
+	}
+}
+
+func TestExecErrors(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	if err := db.Exec("insert 1 user mail"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		query string
+		want  error
+	}{
+		{"insert 1 user mail", ErrDuplicateKey},
+		{"insert -1 user mail", ErrSyntax},
+		{"insert 2 " + strings.Repeat("a", ColumnUsernameSize+1) + " mail", ErrSyntax},
+		{"insert 2 user", ErrSyntax},
+		{"update 1", ErrSyntax},
+		{"select", ErrSyntax},
+	}
+	for _, test := range tests {
+		if err := db.Exec(test.query); !errors.Is(err, test.want) {
+			t.Errorf("Exec(%q): err = %v, want %v", test.query, err, test.want)
+		}
+	}
+	if _, err := db.Query("insert 2 user mail"); !errors.Is(err, ErrSyntax) {
+		t.Errorf("Query(insert): err = %v, want ErrSyntax", err)
+	}
+	if _, err := db.Get(2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(2): err = %v, want ErrNotFound", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Exec("select"); !errors.Is(err, ErrSyntax) {
+		t.Errorf("Tx.Exec(select): err = %v, want ErrSyntax", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClosedDB(t *testing.T) {
+	if _, err := Open("", nil); err == nil {
+		t.Error("Open with no path succeeded")
+	}
+	db := openTestDB(t)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("second Close: err = %v, want ErrClosed", err)
+	}
+	if err := db.Exec("insert 1 user mail"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Exec: err = %v, want ErrClosed", err)
+	}
+	if _, err := db.Query("select"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Query: err = %v, want ErrClosed", err)
+	}
+	if _, err := db.Get(1); !errors.Is(err, ErrClosed) {
+		t.Errorf("Get: err = %v, want ErrClosed", err)
+	}
+}
+
+func TestOpenPageSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	if _, err := Open(path, &Options{PageSize: 4096}); !errors.Is(err, ErrPageSize) {
+		t.Errorf("creating a file with pages of 4096 bytes: err = %v, want ErrPageSize", err)
+	}
+	db, err := Open(path, &Options{PageSize: int(PageSize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pageSize int
+		want     error
+	}{
+		{0, nil},
+		{int(PageSize), nil},
+		{2 * int(PageSize), ErrPageSize},
+	}
+	for _, test := range tests {
+		db, err := Open(path, &Options{PageSize: test.pageSize})
+		if !errors.Is(err, test.want) {
+			t.Errorf("Open with PageSize %d: err = %v, want %v", test.pageSize, err, test.want)
+		}
+		if err == nil {
+			db.Close()
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package db
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 	"unsafe"
 )
 
@@ -23,6 +26,7 @@ type MetaCommandResult int
 const (
 	MetaCommandSuccess MetaCommandResult = iota
 	MetaCommandUnrecognizedCommand
+	MetaCommandFailure
 )
 
 type StatementType int
@@ -30,6 +34,8 @@ type StatementType int
 const (
 	StatementInsert StatementType = iota
 	StatementSelect
+	StatementPragma
+	StatementVacuum
 )
 
 type PrepareResult int
@@ -45,17 +51,10 @@ const (
 type Statement struct {
 	sType       StatementType
 	rowToInsert Row
+	pragma      string // the setting a pragma statement is about
+	pragmaValue string // the value it sets, empty to print it
 }
 
-type ExecuteResult int
-
-const (
-	ExecuteSuccess ExecuteResult = iota
-	ExecuteTableFull
-	ExecuteDuplicateKey
-	ExecuteStatementTypeUnrecognized
-)
-
 type InputBuffer struct {
 	buffer []byte
 }
@@ -69,7 +68,7 @@ const (
 	EmailOffset    = UsernameOffset + UsernameSize
 	RowSize        = IdSize + UsernameSize + EmailSize
 
-	TableMaxPages uint32_t = 100
+	TableMaxPages uint32_t = 1 << 20
 	PageSize      uint32_t = 1024
 )
 
@@ -79,16 +78,44 @@ type Table struct {
 }
 
 type Pager struct {
-	fileDescriptor *os.File
-	fileLength     uint32_t
+	mu             sync.Mutex // guards the page cache while readers share the pager
+	storage        Storage
+	fileDescriptor *os.File // the database file the locks are taken on, nil without one
+	mapping        *mapping // page reads are served from, nil unless Options.MMap
 	numPages       uint32_t
-	headers        [TableMaxPages]*PageHeader
-	bodies         [TableMaxPages]unsafe.Pointer
+	lockMu         sync.Mutex // guards the file locks below
+	lock           lockState
+	users          int      // statements and transactions sharing the shared lock
+	lockFile       *os.File // holds the reserved lock
+	changeCounter  uint32_t // the file's change counter as the cache last saw it
+	generation     uint32_t // counts the vacuums that moved every page, see Bucket
+	busyTimeout    time.Duration
+	readOnly       bool
+	synchronous    Synchronous
+	headers        []*PageHeader // cached pages, grown on demand by getPage
+	bodies         []unsafe.Pointer
+	dirty          []bool // cached pages changed since they were last written back
+	fresh          bool   // the cache lays out a new database the storage does not hold yet
+
+	version uint64                        // number of transactions committed since open
+	readers map[uint64]int                // open snapshots by the version they see
+	history map[uint32_t][]versionedImage // replaced page images open snapshots may still need
+	latches map[uint32_t]*sync.Mutex      // page latches of transactions inserting at once
+
+	// Views of base. A snapshot reads base's pages as of version, a
+	// transaction's view keeps private copies of them in pages.
+	base      *Pager
+	mapped    map[uint32_t]pageImage // the snapshot's copies of pages in the mapping
+	pages     map[uint32_t]*pageCopy
+	allocated []uint32_t               // pages the transaction allocated, in order
+	latched   map[uint32_t]*sync.Mutex // latches the transaction holds
 }
 
 type PageHeader struct {
-	pageType      PageType
-	isRoot        uint8_t
+	pageType PageType
+	isRoot   uint8_t
+	// parentPointer is only a hint: inserts follow the path they came down,
+	// and an internal node split leaves it stale on the children it moves.
 	parentPointer uint32_t
 	numCells      uint32_t
 }
@@ -110,6 +137,7 @@ type InternalPage struct {
 
 type LeafPageBody struct {
 	nextLeaf uint32_t
+	prevLeaf uint32_t
 	cells    [LeafNodeMaxCells]LeafPageCell
 }
 
@@ -139,21 +167,52 @@ type Cursor struct {
 	pageNum    uint32_t
 	cellNum    uint32_t
 	endOfTable bool
-}
+	path       []uint32_t // internal pages from the root down to the leaf, set by find
 
-func dbOpen(fileName *string) *Table {
-	pager := pagerOpen(fileName)
+	// set on cursors handed out by DB.Cursor, whose pageNum and cellNum are
+	// where row was read from, in pages of the given generation
+	db         *DB
+	tx         *Tx
+	row        Row
+	generation uint32_t
+	err        error
+}
 
+func dbOpen(fileName *string, opts *Options) (*Table, error) {
+	pager, err := pagerOpen(fileName, opts)
+	if err != nil {
+		return nil, err
+	}
 	table := new(Table)
 	table.pager = pager
-	table.rootPageNum = 0
-	if pager.numPages == 0 {
-		header, body := pager.getPage(0)
-		leafPage := LeafPage{header: header, body: (*LeafPageBody)(body)}
-		leafPage.initializeLeafNode()
-		leafPage.setNodeRoot(true)
+	if err := table.lockShared(); err != nil {
+		pager.closeStorage()
+		return nil, err
+	}
+
+	if pager.fresh && opts.PageSize != 0 && opts.PageSize != int(PageSize) {
+		err = fmt.Errorf("%w: pages of %d bytes are not supported, only of %d", ErrPageSize, opts.PageSize, PageSize)
 	}
-	return table
+	var meta *MetaPageBody
+	if err == nil {
+		meta, err = pager.meta()
+	}
+	if err == ErrOldFormat && !pager.readOnly {
+		if err = table.upgrade(); err == nil {
+			meta, err = pager.meta()
+		}
+	}
+	if err == nil && opts.PageSize != 0 && int(meta.pageSize) != opts.PageSize {
+		err = fmt.Errorf("%w: the database has pages of %d bytes, not %d", ErrPageSize, meta.pageSize, opts.PageSize)
+	}
+	if err != nil {
+		pager.unlock()
+		pager.closeStorage()
+		return nil, err
+	}
+	table.rootPageNum = meta.tableRoot
+	pager.unlockShared()
+	return table, nil
 }
 
 func printConstants() {
@@ -175,33 +234,57 @@ func (c *InternalPageCell) moveTo(dest *InternalPageCell) {
 		((*[InternalNodeCellSize]byte)(unsafe.Pointer(c)))[:])
 }
 
-func pagerOpen(fileName *string) *Pager {
-	fd, err := os.OpenFile(*fileName, os.O_RDWR|os.O_CREATE, 0755) //fd实际为file指针，文件描述符用*File.fd()获取
-	if err != nil {
-		fmt.Println("Unable to open file.")
-		os.Exit(ExitFailure)
+func pagerOpen(fileName *string, opts *Options) (*Pager, error) {
+	pager := new(Pager)
+	pager.busyTimeout = opts.BusyTimeout
+	pager.readOnly = opts.ReadOnly
+	pager.synchronous = opts.Synchronous
+	if pager.synchronous == SynchronousDefault {
+		pager.synchronous = SynchronousNormal
+	}
+	switch {
+	case opts.Storage != nil:
+		pager.storage = opts.Storage
+	case *fileName == MemoryPath:
+		if opts.ReadOnly {
+			return nil, fmt.Errorf("an in-memory database can not be opened read-only")
+		}
+		pager.storage = NewMemoryStorage()
+	default:
+		flag := os.O_RDWR | os.O_CREATE
+		if opts.ReadOnly {
+			flag = os.O_RDONLY
+		}
+		fd, err := os.OpenFile(*fileName, flag, 0755) //fd实际为file指针，文件描述符用*File.fd()获取
+		if err != nil {
+			return nil, fmt.Errorf("unable to open file: %w", err)
+		}
+		pager.storage = NewFileStorage(fd)
+		pager.fileDescriptor = fd
+		if opts.MMap {
+			pager.mapping = &mapping{file: fd}
+		}
+	}
+	if pager.fileDescriptor != nil {
+		// looked at under the shared lock, another process may be writing it
+		return pager, nil
 	}
-	fileInfo, err := fd.Stat()
+	size, err := pager.storage.Size()
 	if err != nil {
-		fmt.Println("Unable to get file info.")
-		os.Exit(ExitFailure)
+		pager.closeStorage()
+		return nil, fmt.Errorf("unable to get file info: %w", err)
 	}
-	fileLength := fileInfo.Size()
-
-	pager := new(Pager)
-	pager.fileDescriptor = fd
-	pager.fileLength = uint32_t(fileLength)
-	pager.numPages = uint32_t(fileLength) / PageSize
-	if uint32_t(fileLength)%PageSize != 0 {
-		fmt.Println("Db file is not a whole number of pages. Corrupt file.")
-		os.Exit(ExitFailure)
+	if size%int64(PageSize) != 0 {
+		pager.closeStorage()
+		return nil, fmt.Errorf("%w: db file is not a whole number of pages", ErrCorrupt)
 	}
+	pager.numPages = uint32_t(size / int64(PageSize))
 
-	return pager
+	return pager, nil
 }
 
 func (row Row) printRow() {
-	fmt.Printf("(%d, %s, %s)\n", row.id, row.username, row.email)
+	fmt.Printf("(%d, %s, %s)\n", row.id, row.Username(), row.Email())
 }
 
 func (row *Row) serializeRow(destination unsafe.Pointer) {
@@ -214,116 +297,245 @@ func (row *Row) deSerializeRow(source unsafe.Pointer) {
 		((*[RowSize]byte)(source))[:])
 }
 
-func (c *Cursor) cursorValue() *Row {
+func (c *Cursor) cursorValue() (*Row, error) {
 	pageNum := c.pageNum
-	header, body := c.table.pager.getPage(pageNum)
+	header, body, err := c.table.pager.getPage(pageNum)
+	if err != nil {
+		return nil, err
+	}
 	leafPage := LeafPage{header: header, body: (*LeafPageBody)(body)}
-	return leafPage.leafNodeValue(c.cellNum)
+	return leafPage.leafNodeValue(c.cellNum), nil
 }
 
-func (p *Pager) getPage(pageNum uint32_t) (*PageHeader, unsafe.Pointer) {
-	if pageNum > TableMaxPages {
-		fmt.Printf("Tried to fetch page number out of bounds. %d > %d\n", pageNum, TableMaxPages)
-		os.Exit(ExitFailure)
+func (p *Pager) getPage(pageNum uint32_t) (*PageHeader, unsafe.Pointer, error) {
+	if pageNum >= TableMaxPages {
+		return nil, nil, fmt.Errorf("%w: tried to fetch page number out of bounds. %d >= %d",
+			ErrTableFull, pageNum, TableMaxPages)
+	}
+	if p.pages != nil {
+		return p.getPrivatePage(pageNum)
+	} else if p.base != nil {
+		return p.getSnapshotPage(pageNum)
 	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.loadPage(pageNum); err != nil {
+		return nil, nil, err
+	}
+	if p.mapping != nil && p.mapping.contains(p.headers[pageNum]) {
+		// the caller may change the page in place, which the mapping can
+		// not take
+		header := *p.headers[pageNum]
+		body := *(*[PageBodySize]byte)(p.bodies[pageNum])
+		p.headers[pageNum] = &header
+		p.bodies[pageNum] = unsafe.Pointer(&body)
+	}
+	return p.headers[pageNum], p.bodies[pageNum], nil
+}
+
+// loadPage makes sure the page is in the cache. p.mu must be held.
+func (p *Pager) loadPage(pageNum uint32_t) error {
+	p.growCache(pageNum)
 	if p.headers[pageNum] == nil {
-		header, bodyArr := p._getPage(pageNum)
+		header, bodyArr, err := p._getPage(pageNum)
+		if err != nil {
+			return err
+		}
 		p.headers[pageNum] = header
 		//leafBody := (*LeafPageBody)(unsafe.Pointer(bodyArr))
 		p.bodies[pageNum] = unsafe.Pointer(bodyArr)
 	}
-	return p.headers[pageNum], p.bodies[pageNum]
+	return nil
 }
 
-func (p *Pager) _getPage(pageNum uint32_t) (*PageHeader, *[PageBodySize]byte) {
-	numPages := p.fileLength / PageSize
-	header := new(PageHeader)
-	var b [PageSize]byte
-	var bodyRawArr [PageBodySize]byte
-	if p.fileLength%PageSize != 0 {
-		numPages += 1
+// growCache makes room for the page in the cache. p.mu must be held.
+func (p *Pager) growCache(pageNum uint32_t) {
+	if n := int(pageNum) + 1; n > len(p.headers) {
+		p.headers = append(p.headers, make([]*PageHeader, n-len(p.headers))...)
+		p.bodies = append(p.bodies, make([]unsafe.Pointer, n-len(p.bodies))...)
+		p.dirty = append(p.dirty, make([]bool, n-len(p.dirty))...)
 	}
-	if pageNum < numPages {
-		_, err := p.fileDescriptor.Seek(int64(pageNum*PageSize), 0)
-		if err != nil {
-			fmt.Println("Error occurred while moving ptr.")
-			os.Exit(ExitFailure)
-		}
+}
 
-		_, err = p.fileDescriptor.Read(b[:])
+func (p *Pager) _getPage(pageNum uint32_t) (*PageHeader, *[PageBodySize]byte, error) {
+	if p.mapping != nil {
+		b, err := p.mapping.page(pageNum)
 		if err != nil {
-			fmt.Printf("\"Error reading file: %s\n", err)
-			os.Exit(ExitFailure)
+			return nil, nil, fmt.Errorf("error mapping page %d: %w", pageNum, err)
 		}
-		copy(((*[PageHeaderSize]byte)(unsafe.Pointer(header)))[:], b[:])
-		copy(bodyRawArr[:], b[PageHeaderSize:])
+		if b != nil {
+			return (*PageHeader)(unsafe.Pointer(&b[0])), (*[PageBodySize]byte)(unsafe.Pointer(&b[PageHeaderSize])), nil
+		}
+	}
+	header := new(PageHeader)
+	var b [PageSize]byte
+	var bodyRawArr [PageBodySize]byte
+	if err := p.storage.ReadPage(uint32(pageNum), b[:]); err != nil {
+		return nil, nil, fmt.Errorf("error reading page %d: %w", pageNum, err)
 	}
+	copy(((*[PageHeaderSize]byte)(unsafe.Pointer(header)))[:], b[:])
+	copy(bodyRawArr[:], b[PageHeaderSize:])
 	//p.bodies[pageNum] = unsafe.Pointer(&bodyRawArr)
 	if pageNum >= p.numPages {
 		p.numPages = pageNum + 1
 	}
-	return header, &bodyRawArr
+	return header, &bodyRawArr, nil
 }
 
-func (t *Table) dbClose() {
+// dbClose writes the changed pages back to the file and closes it. Writing
+// needs the exclusive lock; if it can not be had, dbClose returns ErrLocked
+// and leaves everything open.
+func (t *Table) dbClose() error {
 	p := t.pager
 
-	for i := uint32_t(0); i < p.numPages; i++ {
-		if p.headers[i] == nil {
-			continue
-		}
-		p.flush(i)
-		p.headers[i] = nil
-		p.bodies[i] = nil
+	if p.lock < lockReserved {
+		p.unlock()
+		return p.closeStorage()
 	}
+	if err := p.writeBack(); errors.Is(err, ErrLocked) {
+		return err
+	} else if err != nil {
+		p.unlock()
+		p.closeStorage()
+		return err
+	}
+	p.unlock()
 
-	err := p.fileDescriptor.Close()
+	err := p.closeStorage()
 	if err != nil {
-		fmt.Println("Error closing db file.")
-		os.Exit(ExitFailure)
+		return fmt.Errorf("error closing db file: %w", err)
 	}
-	for i := uint32_t(0); i < TableMaxPages; i++ {
-		if p.headers[i] != nil {
-			p.headers[i] = nil
-			p.bodies[i] = nil
+	p.headers = nil
+	p.bodies = nil
+	p.dirty = nil
+	return nil
+}
+
+// markDirty records that a page was changed. A transaction's changed pages
+// are made current on commit, and the current ones written back to the file
+// by writeBack.
+func (p *Pager) markDirty(pageNum uint32_t) {
+	if p.pages != nil {
+		if c, ok := p.pages[pageNum]; ok {
+			c.dirty = true
 		}
+		return
 	}
-	t.free()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.growCache(pageNum)
+	p.dirty[pageNum] = true
 }
 
-func (p *Pager) flush(pageNum uint32_t) {
-	if p.headers[pageNum] == nil {
-		fmt.Printf("Tried to flush null page.\n")
-		os.Exit(ExitFailure)
+// writeBack writes the pages changed since they were last written to the
+// file and syncs it. It takes the exclusive lock to write, and goes back to
+// the reserved lock afterwards; ErrLocked means other processes are still
+// reading the file. The meta page of a file is written along with them to
+// count the change, so that other processes know to drop their caches.
+func (p *Pager) writeBack() error {
+	if !p.isDirty() {
+		return nil
 	}
-	_, err := p.fileDescriptor.Seek(int64(pageNum*PageSize), 0)
-	if err != nil {
-		fmt.Printf("Error seeking: %s\n", err)
-		os.Exit(ExitFailure)
+
+	if err := p.lockExclusive(); err != nil {
+		return err
+	}
+	defer p.unlockExclusive()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fileDescriptor != nil {
+		if err := p.loadPage(MetaPageNum); err != nil {
+			return err
+		}
+		p.dirty[MetaPageNum] = true
+		p.changeCounter++
 	}
+	for i, d := range p.dirty {
+		if !d {
+			continue
+		}
+		if p.mapping != nil {
+			p.unmapHistory(uint32_t(i))
+		}
+		if err := p.flush(uint32_t(i)); err != nil {
+			return err
+		}
+		p.dirty[i] = false
+	}
+	if p.synchronous == SynchronousOff {
+		return nil
+	}
+	if err := p.storage.Sync(); err != nil {
+		return fmt.Errorf("error syncing db file: %w", err)
+	}
+	return nil
+}
+
+// isDirty reports whether any cached page has changed since it was last
+// written back.
+func (p *Pager) isDirty() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, d := range p.dirty {
+		if d {
+			return true
+		}
+	}
+	return false
+}
 
-	pageBytesSlice := (*[PageHeaderSize]byte)(unsafe.Pointer(p.headers[pageNum]))[:]
-	pageBytesSlice = append(pageBytesSlice, (*[PageBodySize]byte)(p.bodies[pageNum])[:]...)
-	_, err = p.fileDescriptor.Write(pageBytesSlice)
+// closeStorage unmaps the file, once nothing reads pages from the mapping any
+// more, and closes the storage.
+func (p *Pager) closeStorage() error {
+	if p.mapping != nil {
+		p.mapping.close()
+	}
+	return p.storage.Close()
+}
+
+func (p *Pager) flush(pageNum uint32_t) error {
+	if p.headers[pageNum] == nil {
+		return fmt.Errorf("tried to flush null page %d", pageNum)
+	}
+	page := pageBytes(p.headers[pageNum], p.bodies[pageNum])
+	if pageNum == MetaPageNum {
+		(*MetaPageBody)(unsafe.Pointer(&page[PageHeaderSize])).changeCounter = p.changeCounter
+	}
+	err := p.storage.WritePage(uint32(pageNum), page)
 	if err != nil {
-		fmt.Printf("Error writing: %s\n", err)
-		os.Exit(ExitFailure)
+		return fmt.Errorf("error writing: %w", err)
 	}
+	return nil
 }
 
-func (t *Table) tableStart() *Cursor {
-	cursor := t.find(0)
-	header, body := t.pager.getPage(cursor.pageNum)
+// pageBytes lays out a page as it is stored.
+func pageBytes(header *PageHeader, body unsafe.Pointer) []byte {
+	pageBytesSlice := append([]byte(nil), (*[PageHeaderSize]byte)(unsafe.Pointer(header))[:]...)
+	return append(pageBytesSlice, (*[PageBodySize]byte)(body)[:]...)
+}
+
+func (t *Table) tableStart() (*Cursor, error) {
+	cursor, err := t.find(0)
+	if err != nil {
+		return nil, err
+	}
+	header, body, err := t.pager.getPage(cursor.pageNum)
+	if err != nil {
+		return nil, err
+	}
 	leafPage := LeafPage{header: header, body: (*LeafPageBody)(body)}
 	numCells := *leafPage.leafNodeNumCells()
 	cursor.endOfTable = numCells == 0
 
-	return cursor
+	return cursor, nil
 }
 
-func (c *Cursor) advance() {
+func (c *Cursor) advance() error {
 	pageNum := c.pageNum
-	header, body := c.table.pager.getPage(pageNum)
+	header, body, err := c.table.pager.getPage(pageNum)
+	if err != nil {
+		return err
+	}
 	leafPage := LeafPage{header: header, body: (*LeafPageBody)(body)}
 	c.cellNum += 1
 	if c.cellNum >= header.numCells {
@@ -335,23 +547,16 @@ func (c *Cursor) advance() {
 			c.cellNum = 0
 		}
 	}
+	return nil
 }
 
-func newInputBuffer() *InputBuffer {
-	return new(InputBuffer)
-}
-
-func printPrompt() {
-	fmt.Print("db > ")
-}
+const (
+	prompt             = "db > "
+	continuationPrompt = "   > " // asks for the rest of a statement
+)
 
-func readInput(inputBuffer *InputBuffer) {
-	inputReader := bufio.NewReader(os.Stdin)
-	input, err := inputReader.ReadBytes('\n')
-	if err != nil {
-		fmt.Printf("ReadInput with err: %s\n", err)
-	}
-	inputBuffer.buffer = input
+func printPrompt(prompt string) {
+	fmt.Print(prompt)
 }
 
 func (i *InputBuffer) free() {
@@ -363,39 +568,60 @@ func (t *Table) free() {
 	fmt.Println("Table freed.")
 }
 
+// doMetaCommand runs a meta command other than .exit, which the shell handles
+// itself.
 func doMetaCommand(inputBuffer *InputBuffer, table *Table) MetaCommandResult {
-	if strings.TrimSpace(string(inputBuffer.buffer)) == ".exit" {
-		table.dbClose()
-		os.Exit(ExitSuccess)
+	if strings.TrimSpace(string(inputBuffer.buffer)) == ".flush" {
+		if err := table.pager.writeBack(); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			return MetaCommandFailure
+		}
+		return MetaCommandSuccess
 	} else if strings.TrimSpace(string(inputBuffer.buffer)) == ".constants" {
 		fmt.Println("Constants:")
 		printConstants()
 		return MetaCommandSuccess
 	} else if strings.TrimSpace(string(inputBuffer.buffer)) == ".btree" {
 		fmt.Println("Tree:")
-		table.pager.printTree(0, 0)
+		if err := table.pager.printTree(table.rootPageNum, 0); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			return MetaCommandFailure
+		}
 		return MetaCommandSuccess
 	} else if strings.TrimSpace(string(inputBuffer.buffer)) == ".pages" {
 		for i := uint32_t(0); i < table.pager.numPages; i++ {
-			header, _ := table.pager.getPage(i)
+			header, _, err := table.pager.getPage(i)
+			if err != nil {
+				fmt.Printf("Error: %s\n", err)
+				return MetaCommandFailure
+			}
 			fmt.Println(header.pageType, header.isRoot)
 		}
 		return MetaCommandSuccess
 	} else if strings.TrimSpace(string(inputBuffer.buffer)) == ".keys" {
-		printKeys(table)
+		if err := printKeys(table); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			return MetaCommandFailure
+		}
 		return MetaCommandSuccess
 	} else if strings.TrimSpace(string(inputBuffer.buffer)) == ".kvs" {
-		printKvs(table)
+		if err := printKvs(table); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			return MetaCommandFailure
+		}
 		return MetaCommandSuccess
 	}
 
 	return MetaCommandUnrecognizedCommand
 }
 
-func printKeys(table *Table) {
+func printKeys(table *Table) error {
 	fmt.Println("keys:")
 	for i := uint32_t(0); i < table.pager.numPages; i++ {
-		header, body := table.pager.getPage(i)
+		header, body, err := table.pager.getPage(i)
+		if err != nil {
+			return err
+		}
 		if header.pageType == PageLeaf {
 			cells := (*LeafPageBody)(body).cells
 			fmt.Println("leaf page ", i)
@@ -410,12 +636,16 @@ func printKeys(table *Table) {
 			}
 		}
 	}
+	return nil
 }
 
-func printKvs(table *Table) {
+func printKvs(table *Table) error {
 	fmt.Println("keys&values:")
 	for i := uint32_t(0); i < table.pager.numPages; i++ {
-		header, body := table.pager.getPage(i)
+		header, body, err := table.pager.getPage(i)
+		if err != nil {
+			return err
+		}
 		if header.pageType == PageLeaf {
 			cells := (*LeafPageBody)(body).cells
 			fmt.Println("leaf page ", i)
@@ -433,6 +663,7 @@ func printKvs(table *Table) {
 			}
 		}
 	}
+	return nil
 }
 
 func prepareStatement(inputBuffer *InputBuffer, statement *Statement) PrepareResult {
@@ -444,87 +675,145 @@ func prepareStatement(inputBuffer *InputBuffer, statement *Statement) PrepareRes
 		case "select":
 			statement.sType = StatementSelect
 			return PrepareSuccess
+		case "pragma":
+			return preparePragma(&bufferContent, statement)
+		case "vacuum":
+			if bufferContent != "vacuum" {
+				return PrepareSyntaxError
+			}
+			statement.sType = StatementVacuum
+			return PrepareSuccess
 		}
 	}
 	return PrepareUnrecognizedStatement
 }
 
 func prepareInsert(buffer *string, statement *Statement) PrepareResult {
-	var username string
-	var email string
-
 	statement.sType = StatementInsert
-	splitSlice := strings.Split(*buffer, " ")
+	splitSlice, ok := insertFields(*buffer)
 
-	if len(splitSlice) != 4 {
+	if !ok || len(splitSlice) != 4 {
 		return PrepareSyntaxError
 	}
-	id, err := strconv.Atoi(splitSlice[1])
+	return statement.rowToInsert.setColumns(splitSlice[1], splitSlice[2], splitSlice[3])
+}
+
+// insertFields splits an insert statement into the fields that spaces
+// separate. A field in single quotes may hold spaces and semicolons, and two
+// quotes for one. It reports false for a quote that is left open.
+func insertFields(s string) ([]string, bool) {
+	var fields []string
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			return fields, true
+		}
+		if s[0] != '\'' {
+			end := strings.IndexFunc(s, unicode.IsSpace)
+			if end < 0 {
+				end = len(s)
+			}
+			fields = append(fields, s[:end])
+			s = s[end:]
+			continue
+		}
+		var field strings.Builder
+		i := 1
+		for {
+			j := strings.IndexByte(s[i:], '\'')
+			if j < 0 {
+				return nil, false
+			}
+			field.WriteString(s[i : i+j])
+			i += j + 1
+			if i < len(s) && s[i] == '\'' {
+				field.WriteByte('\'')
+				i++
+				continue
+			}
+			break
+		}
+		fields = append(fields, field.String())
+		s = s[i:]
+	}
+}
+
+// setColumns fills the row from the text of its columns, checking them as an
+// insert statement does.
+func (row *Row) setColumns(idText, username, email string) PrepareResult {
+	id, err := strconv.Atoi(idText)
 	if err != nil {
 		return PrepareSyntaxError
 	}
 	if id < 0 {
 		return PrepareNegativeId
 	}
-
-	username = splitSlice[2]
-	email = splitSlice[3]
 	if len(username) > ColumnUsernameSize || len(email) > ColumnEmailSize {
 		return PrepareStringTooLong
 	}
 
-	statement.rowToInsert.id = uint32_t(uint32(id))
-	copy(statement.rowToInsert.username[:], username)
-	copy(statement.rowToInsert.email[:], email)
+	*row = Row{id: uint32_t(uint32(id))}
+	copy(row.username[:], username)
+	copy(row.email[:], email)
 
 	return PrepareSuccess
 }
 
-func executeStatement(statement *Statement, table *Table) ExecuteResult {
+func executeStatement(statement *Statement, table *Table) error {
 	switch statement.sType {
 	case StatementInsert:
 		return statement.executeInsert(table)
 	case StatementSelect:
-		return statement.executeSelect(table)
+		return statement.executeSelect(table, Row.printRow)
+	case StatementPragma:
+		return statement.executePragma(table)
+	case StatementVacuum:
+		_, err := table.vacuum()
+		return err
 	}
-	return ExecuteStatementTypeUnrecognized
+	return fmt.Errorf("%w: unrecognized statement type", ErrSyntax)
 }
 
-func (s *Statement) executeInsert(table *Table) ExecuteResult {
+func (s *Statement) executeInsert(table *Table) error {
 	//header, body := table.pager.getPage(table.rootPageNum)
 	//leafPage := LeafPage{header: header, body: (*LeafPageBody)(body)}
 	//numCells := *(leafPage.leafNodeNumCells())
 
 	rowToInsert := s.rowToInsert
 	keyToInsert := rowToInsert.id
-	cursor := table.find(keyToInsert)
+	cursor, err := table.find(keyToInsert)
+	if err != nil {
+		return err
+	}
 
-	header, body := table.pager.getPage(cursor.pageNum)
+	header, body, err := table.pager.getPage(cursor.pageNum)
+	if err != nil {
+		return err
+	}
 	leafPage := LeafPage{header: header, body: (*LeafPageBody)(body)}
 	numCells := *leafPage.leafNodeNumCells()
 
 	if cursor.cellNum < numCells {
 		keyAtIndex := *leafPage.leafNodeKey(cursor.cellNum)
 		if keyAtIndex == keyToInsert {
-			return ExecuteDuplicateKey
+			return ErrDuplicateKey
 		}
 	}
-	cursor.leafNodeInsert(rowToInsert.id, &rowToInsert)
-
-	return ExecuteSuccess
+	return cursor.leafNodeInsert(rowToInsert.id, &rowToInsert)
 }
 
-func (c *Cursor) leafNodeInsert(key uint32_t, value *Row) {
-	header, body := c.table.pager.getPage(c.pageNum)
+func (c *Cursor) leafNodeInsert(key uint32_t, value *Row) error {
+	header, body, err := c.table.pager.getPage(c.pageNum)
+	if err != nil {
+		return err
+	}
 	leafPage := LeafPage{header: header, body: (*LeafPageBody)(body)}
 	numCells := *leafPage.leafNodeNumCells()
 	if numCells >= LeafNodeMaxCells {
 		//fmt.Println("Need to implement splitting a leaf node.")
 		//os.Exit(ExitFailure)
-		c.leafNodeSplitAndInsert(key, value)
-		return
+		return c.leafNodeSplitAndInsert(key, value)
 	}
-
 	if c.cellNum < numCells {
 		for i := numCells; i > c.cellNum; i-- {
 			leafPage.leafNodeCell(i - 1).moveTo(leafPage.leafNodeCell(i))
@@ -533,11 +822,17 @@ func (c *Cursor) leafNodeInsert(key uint32_t, value *Row) {
 	*(leafPage.leafNodeNumCells()) += 1
 	*(leafPage.leafNodeKey(c.cellNum)) = key
 	value.serializeRow(unsafe.Pointer(leafPage.leafNodeValue(c.cellNum)))
+	c.table.pager.markDirty(c.pageNum)
+	return nil
 }
 
-func (t *Table) find(key uint32_t) *Cursor {
+func (t *Table) find(key uint32_t) (*Cursor, error) {
 	rootPageNum := t.rootPageNum
-	header, _ := t.pager.getPage(rootPageNum)
+	t.pager.latch(rootPageNum)
+	header, _, err := t.pager.getPage(rootPageNum)
+	if err != nil {
+		return nil, err
+	}
 
 	if header.pageType == PageLeaf {
 		return t.leafNodeFind(rootPageNum, key)
@@ -565,8 +860,11 @@ func (p *InternalPage) setPageType(t PageType) {
 	p.header.pageType = t
 }
 
-func (t *Table) leafNodeFind(pageNum, key uint32_t) *Cursor {
-	header, body := t.pager.getPage(pageNum)
+func (t *Table) leafNodeFind(pageNum, key uint32_t) (*Cursor, error) {
+	header, body, err := t.pager.getPage(pageNum)
+	if err != nil {
+		return nil, err
+	}
 	leafPage := LeafPage{header: header, body: (*LeafPageBody)(body)}
 	numCells := *(leafPage.leafNodeNumCells())
 
@@ -579,7 +877,7 @@ func (t *Table) leafNodeFind(pageNum, key uint32_t) *Cursor {
 		keyAtIndex := *(leafPage.leafNodeKey(index))
 		if key == keyAtIndex {
 			cursor.cellNum = index
-			return &cursor
+			return &cursor, nil
 		}
 		if key < keyAtIndex {
 			onePastMaxIndex = index
@@ -588,66 +886,26 @@ func (t *Table) leafNodeFind(pageNum, key uint32_t) *Cursor {
 		}
 	}
 	cursor.cellNum = minIndex
-	return &cursor
+	return &cursor, nil
 }
 
-func (s *Statement) executeSelect(table *Table) ExecuteResult {
+// executeSelect prints every row with printRow.
+func (s *Statement) executeSelect(table *Table, printRow func(Row)) error {
 	var row Row
-	for c := table.tableStart(); !c.endOfTable; c.advance() {
-		row.deSerializeRow(unsafe.Pointer(c.cursorValue()))
-		row.printRow()
-	}
-	return ExecuteSuccess
-}
-
-func Run(db string) int {
-	if db == "" {
-		fmt.Printf("Must supply a database filename.\n")
-		os.Exit(ExitFailure)
+	c, err := table.tableStart()
+	if err != nil {
+		return err
 	}
-	inputBuffer := newInputBuffer()
-	table := dbOpen(&db)
-
-	for {
-		printPrompt()
-		readInput(inputBuffer)
-
-		if inputBuffer.buffer[0] == '.' {
-			switch doMetaCommand(inputBuffer, table) {
-			case MetaCommandSuccess:
-				continue
-			case MetaCommandUnrecognizedCommand:
-				fmt.Printf("Unrecognized command '%s'\n", inputBuffer.buffer)
-				continue
-			}
-		}
-
-		var statement Statement
-
-		switch prepareStatement(inputBuffer, &statement) {
-		case PrepareSuccess:
-		case PrepareSyntaxError:
-			fmt.Printf("Syntax error. Could not parse statement.\n")
-			continue
-		case PrepareStringTooLong:
-			fmt.Println(" String is too long.")
-			continue
-		case PrepareNegativeId:
-			fmt.Println("ID must be positive.")
-			continue
-		case PrepareUnrecognizedStatement:
-			fmt.Printf("Unrecognized keyword at start of '%s'.\n",
-				strings.TrimSpace(string(inputBuffer.buffer)))
-			continue
+	for !c.endOfTable {
+		value, err := c.cursorValue()
+		if err != nil {
+			return err
 		}
-
-		switch executeStatement(&statement, table) {
-		case ExecuteSuccess:
-			fmt.Println("Executed.")
-		case ExecuteTableFull:
-			fmt.Println("Error: Table full.")
-		case ExecuteDuplicateKey:
-			fmt.Println("Error: Duplicate key.")
+		row.deSerializeRow(unsafe.Pointer(value))
+		printRow(row)
+		if err := c.advance(); err != nil {
+			return err
 		}
 	}
+	return nil
 }
@@ -1,3 +1,5 @@
+package db
+
 // package db
 
 // import (
@@ -0,0 +1,256 @@
+package db
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DriverName is the name the database/sql driver is registered under:
+//
+//	sql.Open("tutorialdb", "file.db")
+const DriverName = "tutorialdb"
+
+func init() {
+	sql.Register(DriverName, &sqlDriver{dbs: make(map[string]*sharedDB)})
+}
+
+// sqlDriver hands out connections backed by one DB per file, so the pool's
+// connections share a page cache instead of overwriting each other's pages.
+type sqlDriver struct {
+	mu  sync.Mutex
+	dbs map[string]*sharedDB
+}
+
+type sharedDB struct {
+	db    *DB
+	conns int
+}
+
+func (d *sqlDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	shared, ok := d.dbs[name]
+	if !ok {
+		db, err := Open(name, nil)
+		if err != nil {
+			return nil, err
+		}
+		shared = &sharedDB{db: db}
+		d.dbs[name] = shared
+	}
+	shared.conns++
+	return &sqlConn{driver: d, name: name, db: shared.db}, nil
+}
+
+func (d *sqlDriver) release(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	shared := d.dbs[name]
+	shared.conns--
+	if shared.conns > 0 {
+		return nil
+	}
+	delete(d.dbs, name)
+	return shared.db.Close()
+}
+
+type sqlConn struct {
+	driver *sqlDriver
+	name   string
+	db     *DB
+	tx     *Tx
+	closed bool
+}
+
+func (c *sqlConn) Prepare(query string) (driver.Stmt, error) {
+	if c.closed {
+		return nil, driver.ErrBadConn
+	}
+	return &sqlStmt{conn: c, query: query, numInput: len(placeholders(query))}, nil
+}
+
+func (c *sqlConn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.tx != nil {
+		c.tx.Rollback()
+		c.tx = nil
+	}
+	return c.driver.release(c.name)
+}
+
+func (c *sqlConn) Begin() (driver.Tx, error) {
+	if c.closed {
+		return nil, driver.ErrBadConn
+	}
+	if c.tx != nil {
+		return nil, fmt.Errorf("db: transaction already in progress")
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	c.tx = tx
+	return &sqlTx{conn: c}, nil
+}
+
+func (c *sqlConn) exec(query string) error {
+	if c.tx != nil {
+		return c.tx.Exec(query)
+	}
+	return c.db.Exec(query)
+}
+
+func (c *sqlConn) query(query string) (*Rows, error) {
+	if c.tx != nil {
+		return c.tx.Query(query)
+	}
+	return c.db.Query(query)
+}
+
+type sqlTx struct {
+	conn *sqlConn
+}
+
+func (t *sqlTx) Commit() error {
+	tx := t.conn.tx
+	t.conn.tx = nil
+	if tx == nil {
+		return ErrTxDone
+	}
+	return tx.Commit()
+}
+
+func (t *sqlTx) Rollback() error {
+	tx := t.conn.tx
+	t.conn.tx = nil
+	if tx == nil {
+		return ErrTxDone
+	}
+	return tx.Rollback()
+}
+
+type sqlStmt struct {
+	conn     *sqlConn
+	query    string
+	numInput int
+}
+
+func (s *sqlStmt) Close() error { return nil }
+
+func (s *sqlStmt) NumInput() int { return s.numInput }
+
+func (s *sqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+	query, err := bind(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	statement, err := prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.conn.exec(query); err != nil {
+		return nil, err
+	}
+	if statement.sType != StatementInsert {
+		return driver.RowsAffected(0), nil
+	}
+	return sqlResult{lastInsertId: int64(statement.rowToInsert.id)}, nil
+}
+
+func (s *sqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	query, err := bind(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.conn.query(query)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlRows{rows: rows}, nil
+}
+
+type sqlResult struct {
+	lastInsertId int64
+}
+
+func (r sqlResult) LastInsertId() (int64, error) { return r.lastInsertId, nil }
+
+func (r sqlResult) RowsAffected() (int64, error) { return 1, nil }
+
+type sqlRows struct {
+	rows *Rows
+}
+
+func (r *sqlRows) Columns() []string { return r.rows.Columns() }
+
+func (r *sqlRows) Close() error { return r.rows.Close() }
+
+func (r *sqlRows) Next(dest []driver.Value) error {
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	row := r.rows.Row()
+	dest[0] = int64(row.ID())
+	dest[1] = row.Username()
+	dest[2] = row.Email()
+	return nil
+}
+
+// bind replaces each ? placeholder in query with the text of its argument,
+// strings quoted as .dump quotes them so that they are read back as they are.
+func bind(query string, args []driver.Value) (string, error) {
+	offsets := placeholders(query)
+	if len(offsets) != len(args) {
+		return "", fmt.Errorf("db: expected %d arguments, got %d", len(offsets), len(args))
+	}
+	var b strings.Builder
+	last := 0
+	for i, arg := range args {
+		b.WriteString(query[last:offsets[i]])
+		last = offsets[i] + 1
+
+		var text string
+		switch v := arg.(type) {
+		case int64:
+			text = strconv.FormatInt(v, 10)
+		case string:
+			text = quoteValue(v)
+		case []byte:
+			text = quoteValue(string(v))
+		default:
+			return "", fmt.Errorf("db: unsupported argument type %T", arg)
+		}
+		b.WriteString(text)
+	}
+	b.WriteString(query[last:])
+	return b.String(), nil
+}
+
+// placeholders returns the offsets of the ? placeholders in query, leaving
+// out question marks between single quotes, as splitStatements reads them.
+func placeholders(query string) []int {
+	var offsets []int
+	quoted := false
+	for i := 0; i < len(query); i++ {
+		switch query[i] {
+		case '\'':
+			quoted = !quoted
+		case '?':
+			if !quoted {
+				offsets = append(offsets, i)
+			}
+		}
+	}
+	return offsets
+}
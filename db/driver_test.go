@@ -0,0 +1,231 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type user struct {
+	id       int64
+	username string
+	email    string
+}
+
+func openTestSQL(t *testing.T) (*sql.DB, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	sqlDB, err := sql.Open(DriverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sqlDB, path
+}
+
+func selectUsers(t *testing.T, q interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}) []user {
+	t.Helper()
+	rows, err := q.Query("select")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var users []user
+	for rows.Next() {
+		var u user
+		if err := rows.Scan(&u.id, &u.username, &u.email); err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return users
+}
+
+func TestDriverInsertAndSelect(t *testing.T) {
+	sqlDB, _ := openTestSQL(t)
+	defer sqlDB.Close()
+
+	for _, id := range []int{3, 1, 2} {
+		res, err := sqlDB.Exec("insert ? ? ?", id, "user", "user@test.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last, _ := res.LastInsertId(); last != int64(id) {
+			t.Errorf("LastInsertId = %d, want %d", last, id)
+		}
+	}
+	want := []user{
+		{1, "user", "user@test.com"},
+		{2, "user", "user@test.com"},
+		{3, "user", "user@test.com"},
+	}
+	if got := selectUsers(t, sqlDB); !reflect.DeepEqual(got, want) {
+		t.Errorf("select = %v, want %v", got, want)
+	}
+
+	cols, err := sqlDB.Query("select")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, _ := cols.Columns()
+	cols.Close()
+	if !reflect.DeepEqual(names, []string{"id", "username", "email"}) {
+		t.Errorf("Columns = %v", names)
+	}
+}
+
+func TestDriverPreparedStatement(t *testing.T) {
+	sqlDB, _ := openTestSQL(t)
+	defer sqlDB.Close()
+
+	stmt, err := sqlDB.Prepare("insert ? name ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	for i := 1; i <= 5; i++ {
+		if _, err := stmt.Exec(i, []byte("mail")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := stmt.Exec(1); err == nil {
+		t.Error("Exec with too few arguments succeeded")
+	}
+	if n := len(selectUsers(t, sqlDB)); n != 5 {
+		t.Errorf("got %d rows, want 5", n)
+	}
+}
+
+func TestDriverQuotedArguments(t *testing.T) {
+	sqlDB, _ := openTestSQL(t)
+	defer sqlDB.Close()
+
+	want := []user{
+		{1, "two words", "a@b.c"},
+		{2, "'bob'", "it's"},
+		{3, "a;b", "--not a comment"},
+		{4, "?", "tab\there"},
+	}
+	for _, u := range want {
+		if _, err := sqlDB.Exec("insert ? ? ?", u.id, u.username, []byte(u.email)); err != nil {
+			t.Fatalf("insert %q %q: %v", u.username, u.email, err)
+		}
+	}
+	if got := selectUsers(t, sqlDB); !reflect.DeepEqual(got, want) {
+		t.Errorf("select = %q, want %q", got, want)
+	}
+}
+
+func TestDriverQuestionMarkInQuotes(t *testing.T) {
+	sqlDB, _ := openTestSQL(t)
+	defer sqlDB.Close()
+
+	stmt, err := sqlDB.Prepare("insert ? 'why?' 'it''s ?'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	if _, err := stmt.Exec(1); err != nil {
+		t.Fatalf("one argument for the one placeholder: %v", err)
+	}
+	if _, err := stmt.Exec(2, "x", "y"); err == nil {
+		t.Error("three arguments for one placeholder succeeded")
+	}
+	if _, err := sqlDB.Exec("insert ? '?' ?", 2, "a?b"); err != nil {
+		t.Fatal(err)
+	}
+	want := []user{{1, "why?", "it's ?"}, {2, "?", "a?b"}}
+	if got := selectUsers(t, sqlDB); !reflect.DeepEqual(got, want) {
+		t.Errorf("select = %q, want %q", got, want)
+	}
+}
+
+func TestDriverDuplicateKey(t *testing.T) {
+	sqlDB, _ := openTestSQL(t)
+	defer sqlDB.Close()
+
+	if _, err := sqlDB.Exec("insert 1 a b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlDB.Exec("insert 1 c d"); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("err = %v, want ErrDuplicateKey", err)
+	}
+}
+
+func TestDriverTransactions(t *testing.T) {
+	sqlDB, _ := openTestSQL(t)
+	defer sqlDB.Close()
+
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		if _, err := tx.Exec("insert ? committed x", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(selectUsers(t, tx)); n != 4 {
+		t.Errorf("transaction sees %d rows, want 4", n)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err = sqlDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enough rows to split leaves and grow a new root before rolling back
+	for i := 5; i <= 9; i++ {
+		if _, err := tx.Exec("insert ? rolledback x", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != sql.ErrTxDone {
+		t.Errorf("Commit after Rollback: err = %v, want sql.ErrTxDone", err)
+	}
+
+	users := selectUsers(t, sqlDB)
+	if len(users) != 4 {
+		t.Fatalf("got %d rows after rollback, want 4", len(users))
+	}
+	for _, u := range users {
+		if u.username != "committed" {
+			t.Errorf("row %d survived the rollback", u.id)
+		}
+	}
+	if _, err := sqlDB.Exec("insert 5 after rollback"); err != nil {
+		t.Errorf("insert after rollback: %v", err)
+	}
+}
+
+func TestDriverPersistence(t *testing.T) {
+	sqlDB, path := openTestSQL(t)
+	for i := 1; i <= 6; i++ {
+		if _, err := sqlDB.Exec("insert ? user mail", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sqlDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sqlDB, err := sql.Open(DriverName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	if n := len(selectUsers(t, sqlDB)); n != 6 {
+		t.Errorf("got %d rows after reopening, want 6", n)
+	}
+}
@@ -0,0 +1,182 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// dumpDatabase writes the statements and commands that recreate the
+// database, as the shell or .read can run them. The table's columns are built
+// in, so the dump only names them in a comment before the rows, each an
+// insert statement in id order. The key/value buckets follow as .bucket
+// commands.
+func dumpDatabase(w io.Writer, table *Table) error {
+	rs, err := selectRows(table)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "-- db_tutorial dump\n-- table %s (id integer, username text(%d), email text(%d))\n", tableName, ColumnUsernameSize, ColumnEmailSize); err != nil {
+		return err
+	}
+	err = rs.each(func(values []string) error {
+		_, err := fmt.Fprintf(w, "insert %s %s %s;\n", values[0], quoteValue(values[1]), quoteValue(values[2]))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	meta, err := table.pager.meta()
+	if err != nil {
+		return err
+	}
+	return dumpBucket(w, table.pager, meta.kvRoot, "/")
+}
+
+// dumpBucket writes the .bucket commands that recreate the pairs and the
+// nested buckets of the bucket at rootPageNum, which path names.
+func dumpBucket(w io.Writer, p *Pager, rootPageNum uint32_t, path string) error {
+	var nested []kvInode
+	_, err := p.kvScan(rootPageNum, nil, func(inode kvInode) (bool, error) {
+		if inode.flags&kvFlagBucket != 0 {
+			nested = append(nested, inode)
+			return true, nil
+		}
+		value, err := p.loadValue(inode)
+		if err != nil {
+			return false, err
+		}
+		_, err = fmt.Fprintf(w, ".bucket put %s %s %s\n", path, hexValue(inode.key), hexValue(value))
+		return err == nil, err
+	})
+	if err != nil {
+		return err
+	}
+	for _, inode := range nested {
+		child := strings.TrimSuffix(path, "/") + "/" + hexValue(inode.key)
+		if _, err := fmt.Fprintf(w, ".bucket create %s\n", child); err != nil {
+			return err
+		}
+		if err := dumpBucket(w, p, uint32_t(binary.LittleEndian.Uint32(inode.value)), child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runBucketCommand runs a .bucket command in a transaction of its own:
+//
+//	.bucket create PATH
+//	.bucket put PATH KEY VALUE
+//
+// PATH is / for the top level bucket, followed by the names of the buckets
+// nested in it separated by /. Names, keys and values are written in hex as
+// x'6b6579', as hexValue writes them.
+func runBucketCommand(table *Table, args []string) error {
+	errUsage := errors.New("usage: .bucket create PATH | .bucket put PATH KEY VALUE")
+	if len(args) < 2 {
+		return errUsage
+	}
+	path, ok := parseBucketPath(args[1])
+	var key, value []byte
+	switch {
+	case !ok:
+		return fmt.Errorf("%w: bad bucket path %s", ErrSyntax, args[1])
+	case args[0] == "create" && len(args) == 2 && len(path) > 0:
+		if len(path[len(path)-1]) > MaxKeySize {
+			return ErrKeyTooLarge
+		}
+	case args[0] == "put" && len(args) == 4:
+		if key, ok = parseHexValue(args[2]); !ok {
+			return fmt.Errorf("%w: bad key %s", ErrSyntax, args[2])
+		}
+		if value, ok = parseHexValue(args[3]); !ok {
+			return fmt.Errorf("%w: bad value %s", ErrSyntax, args[3])
+		}
+		if err := checkPut(key, value); err != nil {
+			return err
+		}
+	default:
+		return errUsage
+	}
+
+	if err := table.pager.reserve(); err != nil {
+		return err
+	}
+	view := table.pager.writer(false)
+	err := func() error {
+		meta, err := view.meta()
+		if err != nil {
+			return err
+		}
+		rootPageNum := meta.kvRoot
+		if args[0] == "create" {
+			for _, name := range path[:len(path)-1] {
+				if rootPageNum, err = view.bucketRoot(rootPageNum, name); err != nil {
+					return err
+				}
+			}
+			_, err = view.createBucket(rootPageNum, path[len(path)-1])
+			return err
+		}
+		for _, name := range path {
+			if rootPageNum, err = view.bucketRoot(rootPageNum, name); err != nil {
+				return err
+			}
+		}
+		return view.bucketPut(rootPageNum, key, value)
+	}()
+	if err != nil {
+		view.rollback()
+		return err
+	}
+	view.commit()
+	return nil
+}
+
+// hexValue writes bytes as x'…', hex digits in quotes, as .bucket commands
+// take them.
+func hexValue(b []byte) string {
+	return "x'" + hex.EncodeToString(b) + "'"
+}
+
+func parseHexValue(s string) ([]byte, bool) {
+	if len(s) < 3 || !strings.HasPrefix(s, "x'") || !strings.HasSuffix(s, "'") {
+		return nil, false
+	}
+	b, err := hex.DecodeString(s[2 : len(s)-1])
+	return b, err == nil
+}
+
+// parseBucketPath returns the names of the nested buckets a .bucket path
+// leads through, none for the top level bucket.
+func parseBucketPath(path string) ([][]byte, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	var names [][]byte
+	for _, field := range strings.Split(path, "/")[1:] {
+		if field == "" && path == "/" {
+			break
+		}
+		name, ok := parseHexValue(field)
+		if !ok || len(name) == 0 {
+			return nil, false
+		}
+		names = append(names, name)
+	}
+	return names, true
+}
+
+// quoteValue returns a value as an insert statement takes it, in quotes if
+// it would not be read back as it is otherwise.
+func quoteValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, "';") && !strings.Contains(value, "--") && strings.IndexFunc(value, unicode.IsSpace) < 0 {
+		return value
+	}
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
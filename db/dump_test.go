@@ -0,0 +1,200 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpAndRead(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	data := filepath.Join(dir, "rows.jsonl")
+	rows := `{"id": 3, "username": "o'brien", "email": "semi;colon@example.com"}
+{"id": 1, "username": "two words", "email": "-- not a comment"}
+{"id": 2, "username": "", "email": "line\nbreak"}
+{"id": 4, "username": "plain", "email": "'quoted'"}
+`
+	for id := 5; id < 200; id++ { // enough to split the root
+		rows += fmt.Sprintf(`{"id": %d, "username": "user%d", "email": "user%d@example.com"}`+"\n", id, id, id)
+	}
+	if err := os.WriteFile(data, []byte(rows), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dump := filepath.Join(dir, "dump.sql")
+	var code int
+	before := captureStdout(t, func() {
+		code = RunShell(path, &ShellOptions{Mode: "json", Commands: []string{".import " + data + " users", ".dump " + dump, "select"}})
+	})
+	if code != ExitSuccess {
+		t.Fatalf("exit code %d, output:\n%s", code, before)
+	}
+	text, err := os.ReadFile(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(text), "insert 1 'two words' '-- not a comment';\ninsert 2 '' 'line\nbreak';\ninsert 3 'o''brien' 'semi;colon@example.com';\n") {
+		t.Errorf("dump:\n%s", text)
+	}
+
+	copyPath := filepath.Join(dir, "copy.db")
+	after := captureStdout(t, func() {
+		code = RunShell(copyPath, &ShellOptions{Mode: "json", Commands: []string{".read " + dump, "select"}})
+	})
+	if code != ExitSuccess {
+		t.Fatalf("exit code %d reading the dump, output:\n%s", code, after)
+	}
+	selected := func(out string) string {
+		return out[strings.Index(out, `{"id":1,`):]
+	}
+	if selected(after) != selected(before) {
+		t.Errorf("select after .read:\n%s\nwant:\n%s", selected(after), selected(before))
+	}
+
+	// .read stops at the first command that fails
+	bad := filepath.Join(dir, "bad.sql")
+	if err := os.WriteFile(bad, []byte("insert 500 a a; insert 1 a a;\ninsert 501 b b;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := captureStdout(t, func() {
+		code = RunShell(copyPath, &ShellOptions{Commands: []string{".read " + bad}})
+	})
+	if code != ExitFailure || !strings.Contains(out, "Duplicate key") || strings.Count(out, "Executed.") != 1 {
+		t.Errorf("exit code %d reading a failing file, output:\n%s", code, out)
+	}
+}
+
+// bucketContents lists the pairs of a bucket and those nested in it, a line
+// each with the path of the bucket they are in.
+func bucketContents(t *testing.T, b *Bucket, path string) []string {
+	t.Helper()
+	var lines []string
+	if err := b.ForEach(func(key, value []byte) error {
+		if value == nil {
+			nested, err := b.Bucket(key)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, bucketContents(t, nested, path+"/"+string(key))...)
+			return nil
+		}
+		lines = append(lines, fmt.Sprintf("%s %q %d %x", path, key, len(value), sha256.Sum256(value)))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestDumpAndReadBuckets(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs := map[string][]byte{
+		"empty":       {},
+		"binary\x00'": {0, 1, 2, '\n', '\''},
+		"big":         bytes.Repeat([]byte("overflow"), int(PageSize)),
+	}
+	for key, value := range pairs {
+		if err := root.Put([]byte(key), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, err := root.CreateBucket([]byte("a b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Put([]byte("k"), []byte("in a")); err != nil {
+		t.Fatal(err)
+	}
+	nested, err := a.CreateBucket([]byte("/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nested.Put([]byte("k"), []byte("in a/")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.CreateBucket([]byte("empty bucket")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("insert 1 user mail"); err != nil {
+		t.Fatal(err)
+	}
+	want := bucketContents(t, root, "")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dump := filepath.Join(dir, "dump.sql")
+	copyPath := filepath.Join(dir, "copy.db")
+	for _, run := range []struct {
+		path    string
+		command string
+	}{{path, ".dump " + dump}, {copyPath, ".read " + dump}} {
+		var code int
+		out := captureStdout(t, func() {
+			code = RunShell(run.path, &ShellOptions{Commands: []string{run.command}})
+		})
+		if code != ExitSuccess {
+			t.Fatalf("%s: exit code %d, output:\n%s", run.command, code, out)
+		}
+	}
+
+	db, err = Open(copyPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	root, err = db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bucketContents(t, root, ""); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("buckets after .read:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	names, err := root.Buckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Errorf("Buckets() = %q, want the two buckets", names)
+	}
+	if _, err := db.Get(1); err != nil {
+		t.Errorf("Get(1): %v", err)
+	}
+}
+
+func TestBucketCommandErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	for _, command := range []string{
+		".bucket",
+		".bucket create /",
+		".bucket create x'61'",
+		".bucket create /x'6'",
+		".bucket create /x'61'/",
+		".bucket put / x'' x'76'",
+		".bucket put / k v",
+		".bucket put /x'61' x'6b' x'76'",
+		".bucket drop /x'61'",
+	} {
+		var code int
+		out := captureStdout(t, func() {
+			code = RunShell(path, &ShellOptions{Commands: []string{command}})
+		})
+		if code != ExitFailure || !strings.HasPrefix(out, "Error: ") {
+			t.Errorf("%s: exit code %d, output %q", command, code, out)
+		}
+	}
+}
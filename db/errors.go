@@ -0,0 +1,31 @@
+package db
+
+import "errors"
+
+var (
+	// ErrDuplicateKey is returned when inserting a row whose id already exists.
+	ErrDuplicateKey = errors.New("db: duplicate key")
+	// ErrCorrupt is returned when the database file is malformed.
+	ErrCorrupt = errors.New("db: database file is corrupt")
+	// ErrTableFull is returned when the table can not grow any further.
+	ErrTableFull = errors.New("db: table full")
+	// ErrNotFound is returned when a requested row does not exist.
+	ErrNotFound = errors.New("db: not found")
+	// ErrSyntax is returned when a statement can not be parsed.
+	ErrSyntax = errors.New("db: syntax error")
+	// ErrClosed is returned when using a database or rows that have been closed.
+	ErrClosed = errors.New("db: database is closed")
+	// ErrLocked is returned when another process holds a lock on the database
+	// file for longer than the busy timeout.
+	ErrLocked = errors.New("db: database is locked")
+	// ErrReadOnly is returned when changing a database opened read-only.
+	ErrReadOnly = errors.New("db: database is open read-only")
+	// ErrOldFormat is returned when opening read-only a file in the layout from
+	// before the meta page, which is converted when it is opened writable.
+	ErrOldFormat = errors.New("db: database file has the old layout, open it writable to convert it")
+	// ErrPageSize is returned when Options.PageSize does not match the page
+	// size of the database or is not supported.
+	ErrPageSize = errors.New("db: page size mismatch")
+	// ErrCrashed is returned by a FaultStorage after Crash.
+	ErrCrashed = errors.New("db: storage crashed")
+)
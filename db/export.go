@@ -0,0 +1,61 @@
+package db
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// exportFormat returns the format to export to a file in when none is
+// given: JSON lines for the extensions importFormat takes for them, CSV for
+// any other.
+func exportFormat(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".jsonl", ".ndjson":
+		return "json"
+	}
+	return "csv"
+}
+
+// exportRows writes the rows of the table to a new file at path, in the
+// format given, and returns how many there were. The rows come one at a time
+// from a cursor over the table, so only one of them is in memory at once.
+// The file is removed again if they can not all be written.
+func exportRows(table *Table, path, format string) (int, error) {
+	rs, err := selectRows(table)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	next := rs.next
+	rs.next = func() ([]string, error) {
+		values, err := next()
+		if values != nil {
+			n++
+		}
+		return values, err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(f)
+	if format == "json" {
+		err = writeJSON(w, rs, false)
+	} else {
+		err = writeCSV(w, rs, true)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return 0, err
+	}
+	return n, nil
+}
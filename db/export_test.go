@@ -0,0 +1,63 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	csvFile := filepath.Join(dir, "out.csv")
+	jsonFile := filepath.Join(dir, "out.jsonl")
+	txtFile := filepath.Join(dir, "out.txt")
+	var code int
+	out := captureStdout(t, func() {
+		code = RunShell(path, &ShellOptions{Commands: []string{
+			"insert 2 b b@example.com",
+			"insert 1 a a@example.com",
+			".export " + csvFile + " select",
+			".export " + jsonFile + " select * from users",
+			".export " + txtFile + " json   select",
+		}})
+	})
+	if code != ExitSuccess {
+		t.Fatalf("exit code %d, output:\n%s", code, out)
+	}
+	if strings.Count(out, "Exported 2 rows to ") != 3 {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	wantJSON := `{"id":1,"username":"a","email":"a@example.com"}` + "\n" + `{"id":2,"username":"b","email":"b@example.com"}` + "\n"
+	for file, want := range map[string]string{
+		csvFile:  "id,username,email\n1,a,a@example.com\n2,b,b@example.com\n",
+		jsonFile: wantJSON,
+		txtFile:  wantJSON,
+	} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s holds:\n%s\nwant:\n%s", filepath.Base(file), data, want)
+		}
+	}
+
+	// what is exported imports again
+	copyPath := filepath.Join(dir, "copy.db")
+	out = captureStdout(t, func() {
+		code = RunShell(copyPath, &ShellOptions{Commands: []string{".import " + csvFile + " users", "select"}})
+	})
+	if code != ExitSuccess || !strings.Contains(out, "(1, a, a@example.com)\n(2, b, b@example.com)\n") {
+		t.Errorf("exit code %d importing the export, output:\n%s", code, out)
+	}
+
+	out = captureStdout(t, func() {
+		code = RunShell(path, &ShellOptions{Commands: []string{".export " + csvFile + " insert 3 c c@example.com"}})
+	})
+	if code != ExitFailure || !strings.Contains(out, "needs a select statement") {
+		t.Errorf("exit code %d exporting an insert, output:\n%s", code, out)
+	}
+}
@@ -0,0 +1,225 @@
+package db
+
+import "sync"
+
+// FaultStorage wraps a Storage to fail on demand, for testing how a database
+// copes with I/O errors, short writes and crashes.
+//
+// Writes go to the wrapped storage only when synced, as they would reach the
+// disk under a file system cache. Until then they are kept by the
+// FaultStorage, so Crash can lose them.
+type FaultStorage struct {
+	mu         sync.Mutex
+	durable    Storage
+	pending    []pendingOp // unsynced writes and truncates, oldest first
+	readFault  fault
+	writeFault writeFault
+	syncFault  fault
+	crashed    bool
+}
+
+// pendingOp is a write of data at offset, or a truncate to offset if data is
+// nil.
+type pendingOp struct {
+	offset int64
+	data   []byte
+}
+
+// fault fails a call with err once after more calls have gone through.
+type fault struct {
+	after int
+	err   error
+}
+
+// writeFault is a fault that writes the first written bytes of the page before
+// failing.
+type writeFault struct {
+	fault
+	written int
+}
+
+// NewFaultStorage returns a FaultStorage on durable, which holds what survives
+// a crash.
+func NewFaultStorage(durable Storage) *FaultStorage {
+	return &FaultStorage{durable: durable}
+}
+
+// FailRead makes a read fail with err after the next after reads.
+func (s *FaultStorage) FailRead(after int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readFault = fault{after: after, err: err}
+}
+
+// FailWrite makes a write fail with err after the next after writes, having
+// written only the first written bytes of its page; any fewer than a page is
+// a short write.
+func (s *FaultStorage) FailWrite(after, written int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeFault = writeFault{fault: fault{after: after, err: err}, written: written}
+}
+
+// FailSync makes a sync fail with err after the next after syncs. Nothing
+// written since the last sync becomes durable.
+func (s *FaultStorage) FailSync(after int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncFault = fault{after: after, err: err}
+}
+
+// Crash loses everything written since the last sync and fails every call
+// from then on with ErrCrashed. The wrapped storage is left as the disk would
+// be, to open the database on again.
+func (s *FaultStorage) Crash() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = nil
+	s.crashed = true
+}
+
+// fire counts a call against f and reports the error it fails with, if any.
+func (f *fault) fire() error {
+	if f.err == nil {
+		return nil
+	}
+	if f.after > 0 {
+		f.after--
+		return nil
+	}
+	err := f.err
+	f.err = nil
+	return err
+}
+
+func (s *FaultStorage) ReadPage(pageNum uint32, page []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.crashed {
+		return ErrCrashed
+	}
+	if err := s.readFault.fire(); err != nil {
+		return err
+	}
+	if err := s.durable.ReadPage(pageNum, page); err != nil {
+		return err
+	}
+	start, end := int64(pageNum)*int64(PageSize), int64(pageNum+1)*int64(PageSize)
+	for _, op := range s.pending {
+		if op.data == nil {
+			// what was cut off reads as zeros, even once the storage grows again
+			for i := op.offset; i < end; i++ {
+				if i >= start {
+					page[i-start] = 0
+				}
+			}
+		} else if op.offset >= start && op.offset < end {
+			copy(page[op.offset-start:], op.data)
+		}
+	}
+	return nil
+}
+
+func (s *FaultStorage) WritePage(pageNum uint32, page []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.crashed {
+		return ErrCrashed
+	}
+	data := page
+	err := s.writeFault.fire()
+	if err != nil && s.writeFault.written < len(page) {
+		data = page[:s.writeFault.written]
+	}
+	if len(data) > 0 {
+		op := pendingOp{offset: int64(pageNum) * int64(PageSize), data: append([]byte(nil), data...)}
+		s.pending = append(s.pending, op)
+	}
+	return err
+}
+
+// Sync writes the pending writes through to the wrapped storage and syncs it.
+func (s *FaultStorage) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.crashed {
+		return ErrCrashed
+	}
+	if err := s.syncFault.fire(); err != nil {
+		return err
+	}
+	size, err := s.size()
+	if err != nil {
+		return err
+	}
+	page := make([]byte, PageSize)
+	for _, op := range s.pending {
+		if op.data == nil {
+			if err := s.durable.Truncate(op.offset); err != nil {
+				return err
+			}
+			continue
+		}
+		// a write may cover part of a page, fill in the rest from the page
+		pageNum := uint32(op.offset / int64(PageSize))
+		if err := s.durable.ReadPage(pageNum, page); err != nil {
+			return err
+		}
+		copy(page[op.offset%int64(PageSize):], op.data)
+		if err := s.durable.WritePage(pageNum, page); err != nil {
+			return err
+		}
+	}
+	// writing whole pages may have overshot a short write
+	if err := s.durable.Truncate(size); err != nil {
+		return err
+	}
+	s.pending = nil
+	return s.durable.Sync()
+}
+
+func (s *FaultStorage) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.crashed {
+		return 0, ErrCrashed
+	}
+	return s.size()
+}
+
+// size is the size of the wrapped storage with the pending writes applied.
+func (s *FaultStorage) size() (int64, error) {
+	size, err := s.durable.Size()
+	if err != nil {
+		return 0, err
+	}
+	for _, op := range s.pending {
+		if op.data == nil {
+			size = op.offset
+		} else if end := op.offset + int64(len(op.data)); end > size {
+			size = end
+		}
+	}
+	return size, nil
+}
+
+func (s *FaultStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.crashed {
+		return ErrCrashed
+	}
+	s.pending = append(s.pending, pendingOp{offset: size})
+	return nil
+}
+
+// Close closes the wrapped storage unless the storage has crashed, so what
+// survived stays open to be looked at.
+func (s *FaultStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.crashed {
+		return ErrCrashed
+	}
+	return s.durable.Close()
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCloseWritesOnlyDirtyPages(t *testing.T) {
+	mem := NewMemoryStorage()
+	db, err := Open("dirty", &Options{Storage: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 300; i++ {
+		if err := db.Exec(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewFaultStorage(mem)
+	db, err = Open("dirty", &Options{Storage: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := scan(t, db); n != 300 {
+		t.Fatalf("scan found %d rows, want 300", n)
+	}
+	// the new row goes into the last leaf, which has room
+	if err := db.Exec("insert 301 user301 user301@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	errWrite := errors.New("page written")
+	s.FailWrite(1, 0, errWrite)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close wrote more than the changed page: %v", err)
+	}
+
+	db, err = Open("dirty", &Options{Storage: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n := scan(t, db); n != 301 {
+		t.Errorf("scan found %d rows, want 301", n)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	mem := NewMemoryStorage()
+	s := NewFaultStorage(mem)
+	db, err := Open("flush", &Options{Storage: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("insert 1 user1 user1@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("insert 2 user2 user2@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	s.Crash()
+
+	db, err = Open("flush", &Options{Storage: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get(1); err != nil {
+		t.Errorf("flushed row lost in crash: %v", err)
+	}
+	if _, err := db.Get(2); err != ErrNotFound {
+		t.Errorf("Get(2) after crash: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	mem := NewMemoryStorage()
+	s := NewFaultStorage(mem)
+	db, err := Open("flush", &Options{Storage: s, FlushInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("insert 1 user1 user1@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if size, _ := mem.Size(); size > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("changes not flushed in the background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.Crash()
+
+	db, err = Open("flush", &Options{Storage: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get(1); err != nil {
+		t.Errorf("flushed row lost in crash: %v", err)
+	}
+}
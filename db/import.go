@@ -0,0 +1,233 @@
+package db
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// rejectedRow is a record that .import left out, and why.
+type rejectedRow struct {
+	line   int
+	reason string
+}
+
+// importFormat returns the format of a file to import, "csv" or "json" for
+// JSON objects one to a line. The name's extension decides, or failing that
+// whether the file starts with an object.
+func importFormat(name string, r *bufio.Reader) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv":
+		return "csv"
+	case ".json", ".jsonl", ".ndjson":
+		return "json"
+	}
+	for n := 1; ; n++ {
+		b, err := r.Peek(n)
+		if err != nil {
+			return "csv"
+		}
+		switch b[n-1] {
+		case '{':
+			return "json"
+		case ' ', '\t', '\r', '\n':
+		default:
+			return "csv"
+		}
+	}
+}
+
+// importRows inserts the records read from r, in the given format, into the
+// table in a single transaction. A record that does not make a valid row, or
+// whose id is taken, is left out and returned with the line it is on. Any
+// other error rolls the whole import back.
+func importRows(table *Table, r io.Reader, format string) (imported int, rejected []rejectedRow, err error) {
+	if err := table.pager.reserve(); err != nil {
+		return 0, nil, err
+	}
+	view := &Table{rootPageNum: table.rootPageNum, pager: table.pager.writer(false)}
+	reject := func(line int, reason string) {
+		rejected = append(rejected, rejectedRow{line: line, reason: reason})
+	}
+	insert := func(line int, values []string) error {
+		statement := Statement{sType: StatementInsert}
+		var reason string
+		if statement.rowToInsert, reason = rowFromValues(values); reason != "" {
+			reject(line, reason)
+			return nil
+		}
+		err := statement.executeInsert(view)
+		if errors.Is(err, ErrDuplicateKey) {
+			reject(line, fmt.Sprintf("duplicate key %s", values[0]))
+			return nil
+		} else if err != nil {
+			return err
+		}
+		imported++
+		return nil
+	}
+
+	if format == "json" {
+		err = readJSONLines(r, insert, reject)
+	} else {
+		err = readCSV(r, insert, reject)
+	}
+	if err != nil {
+		view.pager.rollback()
+		return 0, nil, err
+	}
+	view.pager.commit()
+	return imported, rejected, nil
+}
+
+// rowFromValues makes a row of the values of its columns, or returns why they
+// do not make one.
+func rowFromValues(values []string) (Row, string) {
+	var row Row
+	switch row.setColumns(values[0], values[1], values[2]) {
+	case PrepareSuccess:
+		return row, ""
+	case PrepareNegativeId:
+		return row, "id must be positive"
+	case PrepareStringTooLong:
+		return row, "string is too long"
+	}
+	return row, fmt.Sprintf("id %q is not a number", values[0])
+}
+
+// readCSV reads rows from CSV records. The first record is a header if every
+// field of it names a column, and then gives the order of the columns in the
+// records that follow. Without one they are in the table's order.
+func readCSV(r io.Reader, insert func(line int, values []string) error, reject func(line int, reason string)) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	order := []int{0, 1, 2} // the field each column is in
+	numFields := len(columns)
+	for first := true; ; first = false {
+		record, err := cr.Read()
+		var parseErr *csv.ParseError
+		if err == io.EOF {
+			return nil
+		} else if errors.As(err, &parseErr) {
+			reject(parseErr.Line, parseErr.Err.Error())
+			continue
+		} else if err != nil {
+			return err
+		}
+		line, _ := cr.FieldPos(0)
+		if first && isCSVHeader(record) {
+			if order, err = csvHeaderOrder(record); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			numFields = len(record)
+			continue
+		}
+		if len(record) != numFields {
+			reject(line, fmt.Sprintf("expected %d fields, found %d", numFields, len(record)))
+			continue
+		}
+		values := make([]string, len(columns))
+		for i, field := range order {
+			values[i] = record[field]
+		}
+		if err := insert(line, values); err != nil {
+			return err
+		}
+	}
+}
+
+func isCSVHeader(record []string) bool {
+	for _, field := range record {
+		if columnIndex(field) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func csvHeaderOrder(header []string) ([]int, error) {
+	order := []int{-1, -1, -1}
+	for field, name := range header {
+		i := columnIndex(name)
+		if order[i] >= 0 {
+			return nil, fmt.Errorf("column %s is named twice in the header", columns[i])
+		}
+		order[i] = field
+	}
+	for i, field := range order {
+		if field < 0 {
+			return nil, fmt.Errorf("the header has no %s column", columns[i])
+		}
+	}
+	return order, nil
+}
+
+// columnIndex returns the index of the column with the given name, or -1.
+func columnIndex(name string) int {
+	for i, column := range columns {
+		if strings.EqualFold(strings.TrimSpace(name), column) {
+			return i
+		}
+	}
+	return -1
+}
+
+// readJSONLines reads rows from JSON objects, one to a line, that map the
+// names of the columns to their values. Blank lines are skipped.
+func readJSONLines(r io.Reader, insert func(line int, values []string) error, reject func(line int, reason string)) error {
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		text, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if strings.TrimSpace(text) != "" {
+			if values, reason := jsonRow(text); reason != "" {
+				reject(line, reason)
+			} else if err := insert(line, values); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// jsonRow returns the values of the columns in a JSON object, or why there
+// are none.
+func jsonRow(text string) ([]string, string) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(text), &object); err != nil {
+		return nil, err.Error()
+	}
+	values := make([]string, len(columns))
+	seen := make([]bool, len(columns))
+	for name, raw := range object {
+		i := columnIndex(name)
+		if i < 0 {
+			return nil, fmt.Sprintf("unknown column %q", name)
+		}
+		seen[i] = true
+		if i == 0 {
+			var id json.Number
+			if err := json.Unmarshal(raw, &id); err != nil {
+				return nil, fmt.Sprintf("%s must be a number", columns[i])
+			}
+			values[i] = id.String()
+		} else if err := json.Unmarshal(raw, &values[i]); err != nil {
+			return nil, fmt.Sprintf("%s must be a string", columns[i])
+		}
+	}
+	for i := range columns {
+		if !seen[i] {
+			return nil, fmt.Sprintf("missing column %s", columns[i])
+		}
+	}
+	return values, ""
+}
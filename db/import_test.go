@@ -0,0 +1,87 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	csvFile := filepath.Join(dir, "users.csv")
+	csvData := "email,id,username\n" +
+		"a@example.com,1,a\n" +
+		"\"b, c@example.com\",2,b\n" +
+		"dup@example.com,1,dup\n" +
+		"x@example.com,3," + strings.Repeat("x", ColumnUsernameSize+1) + "\n" +
+		"y@example.com,-4,y\n" +
+		"z@example.com,5\n" +
+		"w@example.com,6,w\"\n" +
+		"v@example.com,7,v\n"
+	jsonFile := filepath.Join(dir, "users.data")
+	jsonData := `{"id": 8, "username": "h", "email": "h@example.com"}` + "\n\n" +
+		`{"id": 9, "username": "i", "email": "i@example.com", "age": 3}` + "\n" +
+		`{"id": "ten", "username": "j", "email": "j@example.com"}` + "\n" +
+		`{"id": 11, "username": "k"}` + "\n" +
+		`{"id": 12, "username": "l", "email": "l@example.com"}`
+	noHeader := filepath.Join(dir, "more.csv")
+	if err := os.WriteFile(csvFile, []byte(csvData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(jsonFile, []byte(jsonData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(noHeader, []byte("13,m,m@example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var code int
+	out := captureStdout(t, func() {
+		input := strings.NewReader(".import " + csvFile + " users\n.import " + jsonFile + " users\n.import " + noHeader + " users\n.import " + noHeader + " items\n")
+		code = RunShell(path, &ShellOptions{Input: input, Prompt: true})
+	})
+	if code != ExitSuccess {
+		t.Fatalf("exit code %d, output:\n%s", code, out)
+	}
+	for _, want := range []string{
+		csvFile + ":4: duplicate key 1\n",
+		csvFile + ":5: string is too long\n",
+		csvFile + ":6: id must be positive\n",
+		csvFile + ":7: expected 3 fields, found 2\n",
+		csvFile + ":8: ",
+		"Imported 3 rows, rejected 5.\n",
+		jsonFile + ":3: unknown column \"age\"\n",
+		jsonFile + ":4: id must be a number\n",
+		jsonFile + ":5: missing column email\n",
+		"Imported 2 rows, rejected 3.\n",
+		"Imported 1 rows, rejected 0.\n",
+		"Error: no such table: items\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not hold %q:\n%s", want, out)
+		}
+	}
+
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var ids []uint32
+	rows, err := db.Query("select")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		ids = append(ids, rows.Row().ID())
+	}
+	if fmt.Sprint(ids) != "[1 2 7 8 12 13]" {
+		t.Errorf("imported ids %v, want [1 2 7 8 12 13]", ids)
+	}
+	if row, err := db.Get(2); err != nil || row.Email() != "b, c@example.com" || row.Username() != "b" {
+		t.Errorf("Get(2) = %q, %q, %v", row.Username(), row.Email(), err)
+	}
+}
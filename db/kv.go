@@ -0,0 +1,534 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"unsafe"
+)
+
+var (
+	// ErrKeyRequired is returned when putting an empty key.
+	ErrKeyRequired = errors.New("db: key required")
+	// ErrKeyTooLarge is returned when a key is longer than MaxKeySize.
+	ErrKeyTooLarge = errors.New("db: key too large")
+	// ErrValueTooLarge is returned when a value is longer than MaxValueSize.
+	ErrValueTooLarge = errors.New("db: value too large")
+)
+
+// kvLeafElement and kvInternalElement head each entry of a key/value page.
+// They are packed at the start of the page body, the keys and values they
+// point to follow them.
+type kvLeafElement struct {
+	flags uint32_t
+	pos   uint32_t // offset of the key from the start of the body
+	ksize uint32_t
+	vsize uint32_t
+}
+
+type kvInternalElement struct {
+	pos   uint32_t
+	ksize uint32_t
+	child uint32_t
+}
+
+// OverflowPageBody holds a slice of a value too large to be kept in a leaf.
+// The header's numCells is the number of bytes used in data.
+type OverflowPageBody struct {
+	next uint32_t
+	data [OverflowPageDataSize]byte
+}
+
+/* Key/Value Node Body Layout */
+const (
+	KVLeafElementSize     = uint32_t(unsafe.Sizeof(kvLeafElement{}))
+	KVInternalElementSize = uint32_t(unsafe.Sizeof(kvInternalElement{}))
+	KVMaxEntrySize        = PageBodySize / 4 // so any overflowing node splits in two
+	KVOverflowRefSize     = uint32_t(8)
+	OverflowPageDataSize  = PageBodySize - uint32_t(unsafe.Sizeof(uint32_t(0)))
+
+	MaxKeySize   = 128
+	MaxValueSize = 1 << 24
+)
+
+const (
+	kvFlagOverflow uint32_t = 1 << iota // value is a reference to overflow pages
+	kvFlagBucket                        // value is the root page of a nested bucket
+)
+
+// kvNode is a decoded key/value page. Changes are made to the node and then
+// written back to its page, the way boltdb moves between nodes and pages.
+type kvNode struct {
+	pageNum uint32_t
+	isLeaf  bool
+	inodes  []kvInode
+}
+
+type kvInode struct {
+	flags uint32_t
+	key   []byte
+	value []byte   // leaf only, inline value or overflow reference
+	child uint32_t // internal only
+}
+
+func (p *Pager) readKVNode(pageNum uint32_t) (*kvNode, error) {
+	header, body, err := p.getPage(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	n := &kvNode{pageNum: pageNum}
+	raw := (*[PageBodySize]byte)(body)
+	switch header.pageType {
+	case PageKVLeaf:
+		n.isLeaf = true
+		elements := (*[PageBodySize / KVLeafElementSize]kvLeafElement)(body)
+		if header.numCells > uint32_t(len(elements)) {
+			return nil, fmt.Errorf("%w: key/value page %d has %d elements", ErrCorrupt, pageNum, header.numCells)
+		}
+		for i := uint32_t(0); i < header.numCells; i++ {
+			e := elements[i]
+			// added up in int64, where the sizes can not wrap around
+			if int64(e.pos)+int64(e.ksize)+int64(e.vsize) > int64(PageBodySize) {
+				return nil, fmt.Errorf("%w: key/value element out of page %d", ErrCorrupt, pageNum)
+			}
+			if e.flags&kvFlagOverflow != 0 && e.vsize != KVOverflowRefSize || e.flags&kvFlagBucket != 0 && e.vsize != 4 {
+				return nil, fmt.Errorf("%w: key/value element of page %d has a value of %d bytes", ErrCorrupt, pageNum, e.vsize)
+			}
+			n.inodes = append(n.inodes, kvInode{
+				flags: e.flags,
+				key:   append([]byte(nil), raw[e.pos:e.pos+e.ksize]...),
+				// never nil, so that ForEach tells an empty value from a bucket
+				value: append([]byte{}, raw[e.pos+e.ksize:e.pos+e.ksize+e.vsize]...),
+			})
+		}
+	case PageKVInternal:
+		elements := (*[PageBodySize / KVInternalElementSize]kvInternalElement)(body)
+		if header.numCells > uint32_t(len(elements)) {
+			return nil, fmt.Errorf("%w: key/value page %d has %d elements", ErrCorrupt, pageNum, header.numCells)
+		}
+		for i := uint32_t(0); i < header.numCells; i++ {
+			e := elements[i]
+			if int64(e.pos)+int64(e.ksize) > int64(PageBodySize) {
+				return nil, fmt.Errorf("%w: key/value element out of page %d", ErrCorrupt, pageNum)
+			}
+			n.inodes = append(n.inodes, kvInode{
+				key:   append([]byte(nil), raw[e.pos:e.pos+e.ksize]...),
+				child: e.child,
+			})
+		}
+	default:
+		return nil, fmt.Errorf("%w: page %d is not a key/value page", ErrCorrupt, pageNum)
+	}
+	return n, nil
+}
+
+func (p *Pager) writeKVNode(n *kvNode) error {
+	if n.size() > PageBodySize {
+		return fmt.Errorf("key/value node of %d bytes does not fit in a page", n.size())
+	}
+	header, body, err := p.getPage(n.pageNum)
+	if err != nil {
+		return err
+	}
+	*header = PageHeader{pageType: PageKVInternal, numCells: uint32_t(len(n.inodes))}
+	raw := (*[PageBodySize]byte)(body)
+	*raw = [PageBodySize]byte{}
+	p.markDirty(n.pageNum)
+
+	pos := n.elementSize() * uint32_t(len(n.inodes))
+	if n.isLeaf {
+		header.pageType = PageKVLeaf
+		elements := (*[PageBodySize / KVLeafElementSize]kvLeafElement)(body)
+		for i, inode := range n.inodes {
+			elements[i] = kvLeafElement{
+				flags: inode.flags,
+				pos:   pos,
+				ksize: uint32_t(len(inode.key)),
+				vsize: uint32_t(len(inode.value)),
+			}
+			pos += uint32_t(copy(raw[pos:], inode.key))
+			pos += uint32_t(copy(raw[pos:], inode.value))
+		}
+		return nil
+	}
+	elements := (*[PageBodySize / KVInternalElementSize]kvInternalElement)(body)
+	for i, inode := range n.inodes {
+		elements[i] = kvInternalElement{pos: pos, ksize: uint32_t(len(inode.key)), child: inode.child}
+		pos += uint32_t(copy(raw[pos:], inode.key))
+	}
+	return nil
+}
+
+func (n *kvNode) elementSize() uint32_t {
+	if n.isLeaf {
+		return KVLeafElementSize
+	}
+	return KVInternalElementSize
+}
+
+// size is the number of body bytes the node takes up as a page.
+func (n *kvNode) size() uint32_t {
+	size := n.elementSize() * uint32_t(len(n.inodes))
+	for _, inode := range n.inodes {
+		size += uint32_t(len(inode.key) + len(inode.value))
+	}
+	return size
+}
+
+// search returns the index of the first inode whose key is not less than key.
+func (n *kvNode) search(key []byte) int {
+	return sort.Search(len(n.inodes), func(i int) bool {
+		return bytes.Compare(n.inodes[i].key, key) >= 0
+	})
+}
+
+// childIndex returns the index of the child of an internal node that key
+// belongs to. Each inode's key is a lower bound for the keys of its child.
+func (n *kvNode) childIndex(key []byte) int {
+	index := sort.Search(len(n.inodes), func(i int) bool {
+		return bytes.Compare(n.inodes[i].key, key) > 0
+	})
+	if index > 0 {
+		index--
+	}
+	return index
+}
+
+// writeOrSplitKVNode writes n to its page, first splitting it in pieces if it
+// is too large. It returns the inodes the parent needs for the new pieces.
+func (p *Pager) writeOrSplitKVNode(n *kvNode) ([]kvInode, error) {
+	if n.size() <= PageBodySize {
+		return nil, p.writeKVNode(n)
+	}
+	var nodes []*kvNode
+	current := &kvNode{pageNum: n.pageNum, isLeaf: n.isLeaf}
+	for _, inode := range n.inodes {
+		if len(current.inodes) > 0 && current.size()+n.elementSize()+uint32_t(len(inode.key)+len(inode.value)) > PageBodySize/2 {
+			nodes = append(nodes, current)
+			current = &kvNode{isLeaf: n.isLeaf}
+		}
+		current.inodes = append(current.inodes, inode)
+	}
+	nodes = append(nodes, current)
+
+	var splits []kvInode
+	for i, node := range nodes {
+		if i > 0 {
+			pageNum, err := p.allocatePage()
+			if err != nil {
+				return nil, err
+			}
+			node.pageNum = pageNum
+			splits = append(splits, kvInode{key: node.inodes[0].key, child: pageNum})
+		}
+		if err := p.writeKVNode(node); err != nil {
+			return nil, err
+		}
+	}
+	return splits, nil
+}
+
+// storeValue returns the bytes to keep in the leaf for value, moving values
+// that would make the entry too large to a chain of overflow pages.
+func (p *Pager) storeValue(key, value []byte) ([]byte, uint32_t, error) {
+	if KVLeafElementSize+uint32_t(len(key)+len(value)) <= KVMaxEntrySize {
+		return append([]byte(nil), value...), 0, nil
+	}
+	first, previous := uint32_t(0), uint32_t(0)
+	for rest := value; len(rest) > 0; {
+		pageNum, err := p.allocatePage()
+		if err != nil {
+			return nil, 0, err
+		}
+		header, body, err := p.getPage(pageNum)
+		if err != nil {
+			return nil, 0, err
+		}
+		overflow := (*OverflowPageBody)(body)
+		*overflow = OverflowPageBody{}
+		n := copy(overflow.data[:], rest)
+		rest = rest[n:]
+		*header = PageHeader{pageType: PageOverflow, numCells: uint32_t(n)}
+		p.markDirty(pageNum)
+
+		if first == 0 {
+			first = pageNum
+		} else {
+			_, previousBody, err := p.getPage(previous)
+			if err != nil {
+				return nil, 0, err
+			}
+			(*OverflowPageBody)(previousBody).next = pageNum
+			p.markDirty(previous)
+		}
+		previous = pageNum
+	}
+	ref := make([]byte, KVOverflowRefSize)
+	binary.LittleEndian.PutUint32(ref[0:4], uint32(first))
+	binary.LittleEndian.PutUint32(ref[4:8], uint32(len(value)))
+	return ref, kvFlagOverflow, nil
+}
+
+// loadValue returns the value of a leaf inode, reading its overflow pages.
+func (p *Pager) loadValue(inode kvInode) ([]byte, error) {
+	if inode.flags&kvFlagOverflow == 0 {
+		return inode.value, nil
+	}
+	pageNum := uint32_t(binary.LittleEndian.Uint32(inode.value[0:4]))
+	length := int(binary.LittleEndian.Uint32(inode.value[4:8]))
+	value := make([]byte, 0, length)
+	for pageNum != 0 {
+		header, body, err := p.getPage(pageNum)
+		if err != nil {
+			return nil, err
+		}
+		if header.pageType != PageOverflow || header.numCells > OverflowPageDataSize {
+			return nil, fmt.Errorf("%w: page %d is not an overflow page", ErrCorrupt, pageNum)
+		}
+		overflow := (*OverflowPageBody)(body)
+		value = append(value, overflow.data[:header.numCells]...)
+		pageNum = overflow.next
+	}
+	if len(value) != length {
+		return nil, fmt.Errorf("%w: overflow value is %d bytes, want %d", ErrCorrupt, len(value), length)
+	}
+	return value, nil
+}
+
+// freeValue returns the overflow pages of a leaf inode to the freelist.
+func (p *Pager) freeValue(inode kvInode) error {
+	if inode.flags&kvFlagOverflow == 0 {
+		return nil
+	}
+	pageNum := uint32_t(binary.LittleEndian.Uint32(inode.value[0:4]))
+	for pageNum != 0 {
+		header, body, err := p.getPage(pageNum)
+		if err != nil {
+			return err
+		}
+		if header.pageType != PageOverflow {
+			return fmt.Errorf("%w: page %d is not an overflow page", ErrCorrupt, pageNum)
+		}
+		next := (*OverflowPageBody)(body).next
+		if err := p.freePage(pageNum); err != nil {
+			return err
+		}
+		pageNum = next
+	}
+	return nil
+}
+
+// kvPut stores inode in the tree rooted at rootPageNum. The root keeps its
+// page number when it splits, its contents move to a new page instead.
+func (p *Pager) kvPut(rootPageNum uint32_t, inode kvInode) error {
+	splits, err := p.kvInsert(rootPageNum, inode)
+	if err != nil || len(splits) == 0 {
+		return err
+	}
+	root, err := p.readKVNode(rootPageNum)
+	if err != nil {
+		return err
+	}
+	leftPageNum, err := p.allocatePage()
+	if err != nil {
+		return err
+	}
+	firstKey := root.inodes[0].key
+	root.pageNum = leftPageNum
+	if err := p.writeKVNode(root); err != nil {
+		return err
+	}
+	newRoot := &kvNode{pageNum: rootPageNum}
+	newRoot.inodes = append([]kvInode{{key: firstKey, child: leftPageNum}}, splits...)
+	return p.writeKVNode(newRoot)
+}
+
+func (p *Pager) kvInsert(pageNum uint32_t, inode kvInode) ([]kvInode, error) {
+	n, err := p.readKVNode(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	if n.isLeaf {
+		index := n.search(inode.key)
+		if index < len(n.inodes) && bytes.Equal(n.inodes[index].key, inode.key) {
+			if err := p.freeValue(n.inodes[index]); err != nil {
+				return nil, err
+			}
+			n.inodes[index] = inode
+		} else {
+			n.inodes = append(n.inodes, kvInode{})
+			copy(n.inodes[index+1:], n.inodes[index:])
+			n.inodes[index] = inode
+		}
+		return p.writeOrSplitKVNode(n)
+	}
+
+	index := n.childIndex(inode.key)
+	splits, err := p.kvInsert(n.inodes[index].child, inode)
+	if err != nil || len(splits) == 0 {
+		return nil, err
+	}
+	inodes := make([]kvInode, 0, len(n.inodes)+len(splits))
+	inodes = append(inodes, n.inodes[:index+1]...)
+	inodes = append(inodes, splits...)
+	n.inodes = append(inodes, n.inodes[index+1:]...)
+	return p.writeOrSplitKVNode(n)
+}
+
+// kvGet returns the leaf inode stored under key.
+func (p *Pager) kvGet(rootPageNum uint32_t, key []byte) (kvInode, error) {
+	pageNum := rootPageNum
+	for {
+		n, err := p.readKVNode(pageNum)
+		if err != nil {
+			return kvInode{}, err
+		}
+		if !n.isLeaf {
+			pageNum = n.inodes[n.childIndex(key)].child
+			continue
+		}
+		index := n.search(key)
+		if index < len(n.inodes) && bytes.Equal(n.inodes[index].key, key) {
+			return n.inodes[index], nil
+		}
+		return kvInode{}, ErrNotFound
+	}
+}
+
+// kvDelete removes key from the tree, merging nodes left underfull and
+// collapsing a root with a single child.
+func (p *Pager) kvDelete(rootPageNum uint32_t, key []byte) error {
+	if err := p.kvRemove(rootPageNum, key); err != nil {
+		return err
+	}
+	for {
+		root, err := p.readKVNode(rootPageNum)
+		if err != nil {
+			return err
+		}
+		if root.isLeaf || len(root.inodes) > 1 {
+			return nil
+		}
+		child, err := p.readKVNode(root.inodes[0].child)
+		if err != nil {
+			return err
+		}
+		if err := p.freePage(child.pageNum); err != nil {
+			return err
+		}
+		child.pageNum = rootPageNum
+		if err := p.writeKVNode(child); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *Pager) kvRemove(pageNum uint32_t, key []byte) error {
+	n, err := p.readKVNode(pageNum)
+	if err != nil {
+		return err
+	}
+	if n.isLeaf {
+		index := n.search(key)
+		if index == len(n.inodes) || !bytes.Equal(n.inodes[index].key, key) {
+			return ErrNotFound
+		}
+		if err := p.freeValue(n.inodes[index]); err != nil {
+			return err
+		}
+		n.inodes = append(n.inodes[:index], n.inodes[index+1:]...)
+		return p.writeKVNode(n)
+	}
+
+	index := n.childIndex(key)
+	if err := p.kvRemove(n.inodes[index].child, key); err != nil {
+		return err
+	}
+	return p.kvRebalance(n, index)
+}
+
+// kvRebalance merges the child at index into a sibling once it is less than a
+// quarter full, if the two fit in one page.
+func (p *Pager) kvRebalance(n *kvNode, index int) error {
+	if len(n.inodes) < 2 {
+		return nil
+	}
+	child, err := p.readKVNode(n.inodes[index].child)
+	if err != nil {
+		return err
+	}
+	if len(child.inodes) > 0 && child.size() >= PageBodySize/4 {
+		return nil
+	}
+	left, right := index-1, index
+	if index == 0 {
+		left, right = 0, 1
+	}
+	leftNode, err := p.readKVNode(n.inodes[left].child)
+	if err != nil {
+		return err
+	}
+	rightNode, err := p.readKVNode(n.inodes[right].child)
+	if err != nil {
+		return err
+	}
+	if leftNode.size()+rightNode.size() > PageBodySize {
+		return nil
+	}
+	leftNode.inodes = append(leftNode.inodes, rightNode.inodes...)
+	if err := p.writeKVNode(leftNode); err != nil {
+		return err
+	}
+	if err := p.freePage(rightNode.pageNum); err != nil {
+		return err
+	}
+	n.inodes = append(n.inodes[:right], n.inodes[right+1:]...)
+	return p.writeKVNode(n)
+}
+
+// kvFreeTree returns every page of the tree rooted at pageNum to the freelist,
+// including overflow pages and the trees of nested buckets.
+func (p *Pager) kvFreeTree(pageNum uint32_t) error {
+	n, err := p.readKVNode(pageNum)
+	if err != nil {
+		return err
+	}
+	for _, inode := range n.inodes {
+		if !n.isLeaf {
+			err = p.kvFreeTree(inode.child)
+		} else if inode.flags&kvFlagBucket != 0 {
+			err = p.kvFreeTree(uint32_t(binary.LittleEndian.Uint32(inode.value)))
+		} else {
+			err = p.freeValue(inode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return p.freePage(pageNum)
+}
+
+// kvScan calls fn for every leaf inode with a key not less than start, in key
+// order, until fn returns false or an error.
+func (p *Pager) kvScan(pageNum uint32_t, start []byte, fn func(inode kvInode) (bool, error)) (bool, error) {
+	n, err := p.readKVNode(pageNum)
+	if err != nil {
+		return false, err
+	}
+	if n.isLeaf {
+		for _, inode := range n.inodes[n.search(start):] {
+			if ok, err := fn(inode); !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	for _, inode := range n.inodes[n.childIndex(start):] {
+		if ok, err := p.kvScan(inode.child, start, fn); !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
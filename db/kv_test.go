@@ -0,0 +1,242 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestKVPutGetDelete(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	bucket, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"small", 10},
+		{"just under a page", int(PageBodySize) - 200},
+		{"one overflow page", int(PageSize)},
+		{"several overflow pages", 5 * int(PageSize)},
+	}
+	for i, test := range tests {
+		key := []byte(test.name)
+		value := bytes.Repeat([]byte{byte('a' + i)}, test.size)
+		if err := bucket.Put(key, value); err != nil {
+			t.Fatalf("%s: Put: %v", test.name, err)
+		}
+		got, err := bucket.Get(key)
+		if err != nil {
+			t.Fatalf("%s: Get: %v", test.name, err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("%s: Get returned %d bytes, want %d", test.name, len(got), len(value))
+		}
+	}
+	for _, test := range tests {
+		if err := bucket.Delete([]byte(test.name)); err != nil {
+			t.Fatalf("%s: Delete: %v", test.name, err)
+		}
+		if _, err := bucket.Get([]byte(test.name)); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: Get after Delete: err = %v, want ErrNotFound", test.name, err)
+		}
+	}
+	if err := bucket.Delete([]byte("missing")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete of a missing key: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestKVOverflowPagesReused(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	bucket, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("x"), 4*int(PageSize))
+	if err := bucket.Put([]byte("big"), value); err != nil {
+		t.Fatal(err)
+	}
+	numPages := db.table.pager.numPages
+	// each replacement frees the pages of the value it replaces for the next
+	for i := 0; i < 10; i++ {
+		value[0] = byte(i)
+		if err := bucket.Put([]byte("big"), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := db.table.pager.numPages; got > numPages+uint32_t(len(value))/PageBodySize+1 {
+		t.Errorf("replacing a value 10 times grew the file from %d to %d pages", numPages, got)
+	}
+	got, err := bucket.Get([]byte("big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Error("value read back differs")
+	}
+}
+
+func TestKVPutErrors(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	bucket, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		key, value []byte
+		want       error
+	}{
+		{"empty key", nil, []byte("v"), ErrKeyRequired},
+		{"key too large", make([]byte, MaxKeySize+1), []byte("v"), ErrKeyTooLarge},
+		{"value too large", []byte("k"), make([]byte, MaxValueSize+1), ErrValueTooLarge},
+	}
+	for _, test := range tests {
+		if err := bucket.Put(test.key, test.value); !errors.Is(err, test.want) {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.want)
+		}
+	}
+	if err := bucket.Put(make([]byte, MaxKeySize), []byte("v")); err != nil {
+		t.Errorf("key of MaxKeySize bytes: %v", err)
+	}
+}
+
+// keysOf returns the keys a scan of bucket passes to fn, joined by spaces.
+func keysOf(t *testing.T, scan func(fn func(key, value []byte) error) error) string {
+	t.Helper()
+	var keys []string
+	if err := scan(func(key, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(keys, " ")
+}
+
+func TestKVRange(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	bucket, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enough keys for the tree to split
+	for i := 0; i < 300; i++ {
+		key := []byte(fmt.Sprintf("k%03d", i))
+		if err := bucket.Put(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		start, end string
+		want       string
+	}{
+		{"k010", "k013", "k010 k011 k012"},
+		{"k0105", "k013", "k011 k012"},
+		{"", "k002", "k000 k001"},
+		{"k297", "", "k297 k298 k299"},
+		{"k013", "k010", ""},
+		{"k010", "k010", ""},
+		{"l", "", ""},
+	}
+	for _, test := range tests {
+		var start, end []byte
+		if test.start != "" {
+			start = []byte(test.start)
+		}
+		if test.end != "" {
+			end = []byte(test.end)
+		}
+		got := keysOf(t, func(fn func(key, value []byte) error) error {
+			return bucket.Range(start, end, fn)
+		})
+		if got != test.want {
+			t.Errorf("Range(%q, %q) = %q, want %q", test.start, test.end, got, test.want)
+		}
+	}
+	if got := len(strings.Fields(keysOf(t, bucket.ForEach))); got != 300 {
+		t.Errorf("ForEach saw %d keys, want 300", got)
+	}
+}
+
+func TestKVPrefix(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	bucket, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "a/1", "a/2", "ab", "ab/1", "b/1"} {
+		if err := bucket.Put([]byte(key), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"a/", "a/1 a/2"},
+		{"a", "a a/1 a/2 ab ab/1"},
+		{"ab/", "ab/1"},
+		{"b", "b/1"},
+		{"c", ""},
+	}
+	for _, test := range tests {
+		got := keysOf(t, func(fn func(key, value []byte) error) error {
+			return bucket.Prefix([]byte(test.prefix), fn)
+		})
+		if got != test.want {
+			t.Errorf("Prefix(%q) = %q, want %q", test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestKVCorruptPage(t *testing.T) {
+	db := openTestDB(t)
+	defer db.Close()
+	bucket, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	header, body, err := db.table.pager.getPage(bucket.rootPageNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	element := &(*[PageBodySize / KVLeafElementSize]kvLeafElement)(body)[0]
+	saved, savedElement := *header, *element
+	tests := []struct {
+		name    string
+		corrupt func()
+	}{
+		{"too many leaf elements", func() { header.numCells = PageBodySize }},
+		{"value size that wraps around", func() { element.vsize = ^uint32_t(0) - element.pos }},
+		{"key past the page", func() { element.ksize = PageBodySize }},
+		{"short overflow reference", func() { element.flags = kvFlagOverflow }},
+		{"too many internal elements", func() {
+			header.pageType = PageKVInternal
+			header.numCells = PageBodySize
+		}},
+	}
+	for _, test := range tests {
+		test.corrupt()
+		if _, err := bucket.Get([]byte("k")); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: err = %v, want ErrCorrupt", test.name, err)
+		}
+		*header, *element = saved, savedElement
+	}
+	if value, err := bucket.Get([]byte("k")); err != nil || string(value) != "v" {
+		t.Errorf("Get after restoring the page = %q, %v", value, err)
+	}
+}
@@ -0,0 +1,415 @@
+package db
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// errInterrupted is returned by readLine when Ctrl-C abandons the line.
+var errInterrupted = errors.New("interrupted")
+
+// maxHistory is how many lines the line editor remembers.
+const maxHistory = 1000
+
+// Keys the line editor acts on. Control keys arrive as the runes below,
+// escape sequences are turned into the negative runes of the next block.
+const (
+	ctrlA     rune = 'A' - '@'
+	ctrlB     rune = 'B' - '@'
+	ctrlC     rune = 'C' - '@'
+	ctrlD     rune = 'D' - '@'
+	ctrlE     rune = 'E' - '@'
+	ctrlF     rune = 'F' - '@'
+	ctrlG     rune = 'G' - '@'
+	ctrlH     rune = 'H' - '@'
+	ctrlK     rune = 'K' - '@'
+	ctrlN     rune = 'N' - '@'
+	ctrlP     rune = 'P' - '@'
+	ctrlR     rune = 'R' - '@'
+	ctrlU     rune = 'U' - '@'
+	ctrlW     rune = 'W' - '@'
+	keyTab    rune = '\t'
+	keyEnter  rune = '\r'
+	keyEscape rune = 27
+	keyBack   rune = 127
+)
+
+const (
+	keyUp rune = -(iota + 1)
+	keyDown
+	keyRight
+	keyLeft
+	keyHome
+	keyEnd
+	keyDelete
+	keyUnknown
+)
+
+// lineEditor reads lines typed at a terminal. It puts the terminal in raw
+// mode while a line is typed, so that the arrow keys move through the line
+// and through the lines typed before, Ctrl-R searches those, and Tab
+// completes the word before the cursor.
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	fd       int // the terminal, -1 to leave its mode alone
+	history  []string
+	file     string // where the history is kept, if anywhere
+	complete func(before, word string) []string
+
+	// the line being edited
+	prompt string
+	buf    []rune
+	pos    int
+}
+
+// newLineEditor returns a line editor reading keys from in and echoing them
+// to out, with the history kept in file. complete returns the words that
+// could take the place of word, which follows before on the line.
+func newLineEditor(in io.Reader, out io.Writer, fd int, file string, complete func(before, word string) []string) *lineEditor {
+	e := &lineEditor{in: bufio.NewReader(in), out: out, fd: fd, file: file, complete: complete}
+	e.loadHistory()
+	return e
+}
+
+// loadHistory reads the history file, trimming it to the last maxHistory
+// lines. The history is only a convenience, so a file that can not be read
+// or written leaves it empty.
+func (e *lineEditor) loadHistory() {
+	if e.file == "" {
+		return
+	}
+	data, err := os.ReadFile(e.file)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+		os.WriteFile(e.file, []byte(strings.Join(e.history, "\n")+"\n"), 0600)
+	}
+}
+
+// addHistory remembers a line, unless it is blank or repeats the last one,
+// and appends it to the history file.
+func (e *lineEditor) addHistory(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || len(e.history) > 0 && e.history[len(e.history)-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[1:]
+	}
+	if e.file == "" {
+		return
+	}
+	f, err := os.OpenFile(e.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+// readLine reads a line after printing prompt, ending it with a newline as
+// bufio.Reader.ReadString does. Ctrl-D on an empty line returns io.EOF, and
+// Ctrl-C returns errInterrupted.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	if e.fd >= 0 {
+		state, err := makeRaw(e.fd)
+		if err != nil {
+			return "", err
+		}
+		defer restoreTerminal(e.fd, state)
+	}
+	e.prompt, e.buf, e.pos = prompt, nil, 0
+	index, saved := len(e.history), "" // the history line shown, and the new line while it is not
+	var key rune                       // the key that ended a search, handled next
+	tabbed := false
+	e.refresh()
+	for {
+		r := key
+		if key == 0 {
+			var err error
+			if r, err = e.readKey(); err != nil {
+				return "", err
+			}
+		}
+		key = 0
+		tab := false
+		switch r {
+		case keyEnter, '\n':
+			e.write("\r\n")
+			line := string(e.buf)
+			e.addHistory(line)
+			return line + "\n", nil
+		case ctrlC:
+			e.write("^C\r\n")
+			return "", errInterrupted
+		case ctrlD:
+			if len(e.buf) == 0 {
+				return "", io.EOF
+			}
+			e.delete(e.pos, e.pos+1)
+		case keyDelete:
+			e.delete(e.pos, e.pos+1)
+		case keyBack, ctrlH:
+			e.delete(e.pos-1, e.pos)
+		case ctrlW:
+			start := e.pos
+			for start > 0 && unicode.IsSpace(e.buf[start-1]) {
+				start--
+			}
+			for start > 0 && !unicode.IsSpace(e.buf[start-1]) {
+				start--
+			}
+			e.delete(start, e.pos)
+		case ctrlK:
+			e.delete(e.pos, len(e.buf))
+		case ctrlU:
+			e.delete(0, e.pos)
+		case keyLeft, ctrlB:
+			if e.pos > 0 {
+				e.pos--
+			}
+		case keyRight, ctrlF:
+			if e.pos < len(e.buf) {
+				e.pos++
+			}
+		case keyHome, ctrlA:
+			e.pos = 0
+		case keyEnd, ctrlE:
+			e.pos = len(e.buf)
+		case keyUp, ctrlP:
+			if index > 0 {
+				if index == len(e.history) {
+					saved = string(e.buf)
+				}
+				index--
+				e.setLine(e.history[index])
+			}
+		case keyDown, ctrlN:
+			if index < len(e.history) {
+				index++
+				if index == len(e.history) {
+					e.setLine(saved)
+				} else {
+					e.setLine(e.history[index])
+				}
+			}
+		case keyTab:
+			e.completeWord(tabbed)
+			tab = true
+		case ctrlR:
+			var err error
+			if key, err = e.search(); err != nil {
+				return "", err
+			}
+		default:
+			if r >= ' ' && unicode.IsPrint(r) {
+				e.insert(string(r))
+			}
+		}
+		tabbed = tab
+		e.refresh()
+	}
+}
+
+// readKey reads a key, turning the escape sequences of the arrow keys and
+// the like into the key they stand for.
+func (e *lineEditor) readKey() (rune, error) {
+	r, _, err := e.in.ReadRune()
+	if err != nil || r != keyEscape {
+		return r, err
+	}
+	if r, _, err = e.in.ReadRune(); err != nil {
+		return 0, err
+	}
+	if r != '[' && r != 'O' {
+		return keyUnknown, nil
+	}
+	var params []rune
+	for {
+		if r, _, err = e.in.ReadRune(); err != nil {
+			return 0, err
+		}
+		if r >= 0x40 && r <= 0x7e {
+			break
+		}
+		params = append(params, r)
+	}
+	switch r {
+	case 'A':
+		return keyUp, nil
+	case 'B':
+		return keyDown, nil
+	case 'C':
+		return keyRight, nil
+	case 'D':
+		return keyLeft, nil
+	case 'H':
+		return keyHome, nil
+	case 'F':
+		return keyEnd, nil
+	case '~':
+		switch string(params) {
+		case "1", "7":
+			return keyHome, nil
+		case "4", "8":
+			return keyEnd, nil
+		case "3":
+			return keyDelete, nil
+		}
+	}
+	return keyUnknown, nil
+}
+
+func (e *lineEditor) insert(s string) {
+	runes := []rune(s)
+	e.buf = append(e.buf[:e.pos], append(runes, e.buf[e.pos:]...)...)
+	e.pos += len(runes)
+}
+
+// delete removes the runes from start up to end, as far as the line goes.
+func (e *lineEditor) delete(start, end int) {
+	if start < 0 {
+		start = 0
+	}
+	if end > len(e.buf) {
+		end = len(e.buf)
+	}
+	if start >= end {
+		return
+	}
+	e.buf = append(e.buf[:start], e.buf[end:]...)
+	if e.pos > end {
+		e.pos -= end - start
+	} else if e.pos > start {
+		e.pos = start
+	}
+}
+
+func (e *lineEditor) setLine(line string) {
+	e.buf = []rune(line)
+	e.pos = len(e.buf)
+}
+
+// search searches back through the history for lines holding what is typed
+// after Ctrl-R, which finds the next older one. The line found is kept when
+// the search ends with any other key, which it returns for readLine to
+// handle; Ctrl-G ends it with the line as it was before.
+func (e *lineEditor) search() (rune, error) {
+	original := string(e.buf)
+	var query []rune
+	match, found := len(e.history), true
+	for {
+		e.refreshSearch(string(query), found)
+		r, err := e.readKey()
+		if err != nil {
+			return 0, err
+		}
+		from := match
+		switch {
+		case r == ctrlR:
+			from = match - 1
+		case r == keyBack || r == ctrlH:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+			}
+			from = len(e.history) - 1
+		case r == ctrlG:
+			e.setLine(original)
+			return 0, nil
+		case r >= ' ' && unicode.IsPrint(r):
+			query = append(query, r)
+		default:
+			return r, nil
+		}
+		if len(query) == 0 {
+			found = true
+			continue
+		}
+		if from >= len(e.history) {
+			from = len(e.history) - 1
+		}
+		found = false
+		for i := from; i >= 0; i-- {
+			if r == ctrlR && e.history[i] == string(e.buf) {
+				continue // the same line again
+			}
+			if j := strings.Index(e.history[i], string(query)); j >= 0 {
+				match, found = i, true
+				e.setLine(e.history[i])
+				e.pos = len([]rune(e.history[i][:j]))
+				break
+			}
+		}
+	}
+}
+
+// completeWord completes the word before the cursor. A word that can go on
+// in more than one way is completed as far as the ways agree, and then
+// again lists them.
+func (e *lineEditor) completeWord(again bool) {
+	if e.complete == nil {
+		return
+	}
+	start := e.pos
+	for start > 0 && !unicode.IsSpace(e.buf[start-1]) {
+		start--
+	}
+	word := string(e.buf[start:e.pos])
+	matches := e.complete(string(e.buf[:start]), word)
+	switch len(matches) {
+	case 0:
+		e.write("\a")
+		return
+	case 1:
+		e.insert(matches[0][len(word):] + " ")
+		return
+	}
+	prefix := matches[0]
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(prefix) > len(word) {
+		e.insert(prefix[len(word):])
+	} else if again {
+		e.write("\r\n" + strings.Join(matches, "  ") + "\r\n")
+	} else {
+		e.write("\a")
+	}
+}
+
+// refresh redraws the line and puts the cursor back where it is in it.
+func (e *lineEditor) refresh() {
+	s := "\r" + e.prompt + string(e.buf) + "\x1b[K"
+	if n := len(e.buf) - e.pos; n > 0 {
+		s += fmt.Sprintf("\x1b[%dD", n)
+	}
+	e.write(s)
+}
+
+func (e *lineEditor) refreshSearch(query string, found bool) {
+	prefix := "(reverse-i-search)"
+	if !found {
+		prefix = "(failing reverse-i-search)"
+	}
+	e.write("\r" + prefix + "`" + query + "': " + string(e.buf) + "\x1b[K")
+}
+
+func (e *lineEditor) write(s string) {
+	io.WriteString(e.out, s)
+}
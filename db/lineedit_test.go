@@ -0,0 +1,100 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	up   = "\x1b[A"
+	left = "\x1b[D"
+)
+
+// typeKeys types keys at a line editor and returns the lines it reads up to
+// the end of the keys, and what it echoes.
+func typeKeys(t *testing.T, e *lineEditor, keys string) ([]string, string) {
+	t.Helper()
+	var out bytes.Buffer
+	e.in.Reset(strings.NewReader(keys))
+	e.out = &out
+	var lines []string
+	for {
+		line, err := e.readLine(prompt)
+		if err == io.EOF {
+			return lines, out.String()
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+}
+
+func TestLineEditorEditing(t *testing.T) {
+	e := newLineEditor(nil, nil, -1, "", completeShell)
+	lines, _ := typeKeys(t, e, "selct"+left+left+"e\r"+"insert 1 a b\x17\x17c d\r"+"abc\x01x\x05y\x02\x02\x0b\r")
+	want := []string{"select", "insert 1 c d", "xab"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("lines %q, want %q", lines, want)
+	}
+
+	e.in.Reset(strings.NewReader("half\x03"))
+	if _, err := e.readLine(prompt); !errors.Is(err, errInterrupted) {
+		t.Errorf("Ctrl-C: %v, want errInterrupted", err)
+	}
+}
+
+func TestLineEditorHistory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history")
+	e := newLineEditor(nil, nil, -1, file, completeShell)
+	lines, _ := typeKeys(t, e, "insert 1 a b;\r\r"+"select;\r"+"select;\r"+up+up+"\r"+"new"+up+"\x1b[B!\r")
+	want := []string{"insert 1 a b;", "", "select;", "select;", "insert 1 a b;", "new!"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("lines %q, want %q", lines, want)
+	}
+
+	// blank lines and repeats are left out
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "insert 1 a b;\nselect;\ninsert 1 a b;\nnew!\n"; string(data) != want {
+		t.Errorf("history file %q, want %q", data, want)
+	}
+
+	// the next session starts from the file
+	e = newLineEditor(nil, nil, -1, file, completeShell)
+	lines, _ = typeKeys(t, e, up+up+up+"\r")
+	if len(lines) != 1 || lines[0] != "select;" {
+		t.Errorf("lines %q after reopening, want select;", lines)
+	}
+}
+
+func TestLineEditorSearch(t *testing.T) {
+	e := newLineEditor(nil, nil, -1, "", completeShell)
+	e.history = []string{"insert 1 a b;", "select;", "insert 2 c d;", "pragma synchronous;"}
+	lines, out := typeKeys(t, e, "\x12ins\r"+"\x12ins\x12\r"+"\x12sel"+"\x1b[F x\r"+"\x12zz\x07mine\r")
+	want := []string{"insert 2 c d;", "insert 1 a b;", "select; x", "mine"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("lines %q, want %q", lines, want)
+	}
+	if !strings.Contains(out, "(failing reverse-i-search)`zz'") {
+		t.Errorf("no failed search in output %q", out)
+	}
+}
+
+func TestLineEditorCompletion(t *testing.T) {
+	e := newLineEditor(nil, nil, -1, "", completeShell)
+	lines, out := typeKeys(t, e, "sel\tid, ema\tfrom us\ts\t\r"+".co\t\r"+"pragma syn\t= fu\t\r"+".k\t\ts\r")
+	want := []string{"select id, email from users ", ".constants ", "pragma synchronous = full ", ".ks"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("lines %q, want %q", lines, want)
+	}
+	if !strings.Contains(out, ".keys  .kvs") {
+		t.Errorf("second Tab did not list .keys and .kvs in %q", out)
+	}
+}
@@ -0,0 +1,294 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"time"
+	"unsafe"
+)
+
+// lockState is how far a process has locked the database file, as in SQLite.
+// A process holds a shared lock while it reads the file, for the length of a
+// statement or transaction, which keeps other processes from writing to the
+// file under it. The first change takes the reserved lock, held by one process
+// at a time until the change has been written back, and writing to the file
+// needs the exclusive lock, which waits for all other shared locks to go.
+type lockState int
+
+const (
+	lockNone lockState = iota
+	lockShared
+	lockReserved
+	lockExclusive
+)
+
+// lockShared takes a shared lock on the database file for a statement or a
+// transaction, which must give it up with unlockShared. Those running at once
+// share the one lock. When it is taken anew, the cache is dropped if another
+// process has changed the file since.
+func (t *Table) lockShared() error {
+	p := t.pager
+	p.lockMu.Lock()
+	defer p.lockMu.Unlock()
+	if p.users > 0 || p.lock == lockExclusive {
+		p.users++
+		return nil
+	}
+	replaced := false
+	for {
+		if err := p.retry(func() (bool, error) { return p.tryLock(false) }); err != nil {
+			return err
+		}
+		if p.fileDescriptor == nil {
+			break
+		}
+		ok, err := p.reopenIfReplaced()
+		if err != nil {
+			return err
+		} else if !ok {
+			break
+		}
+		replaced = true
+	}
+	// only the holder of the reserved lock writes to the file
+	if p.lock < lockReserved && p.fileDescriptor != nil {
+		changed, err := p.revalidate()
+		if err == nil && (changed || replaced) && p.numPages > 0 {
+			var meta *MetaPageBody
+			if meta, err = p.meta(); err == nil {
+				t.rootPageNum = meta.tableRoot
+			} else if err == ErrOldFormat {
+				err = nil // for dbOpen to convert
+			}
+		}
+		if err != nil {
+			unlockFile(p.fileDescriptor)
+			return err
+		}
+	}
+	// an empty file is an empty database until the first change writes it
+	if p.numPages == 0 {
+		err := p.initializeFresh()
+		var meta *MetaPageBody
+		if err == nil {
+			meta, err = p.meta()
+		}
+		if err != nil {
+			if p.fileDescriptor != nil {
+				unlockFile(p.fileDescriptor)
+			}
+			return err
+		}
+		t.rootPageNum = meta.tableRoot
+	}
+	p.users++
+	if p.lock == lockNone {
+		p.lock = lockShared
+	}
+	return nil
+}
+
+// unlockShared ends what lockShared began. The last to end gives up the shared
+// lock, and the reserved lock with it unless changes are waiting in the cache
+// to be written back.
+func (p *Pager) unlockShared() {
+	p.lockMu.Lock()
+	defer p.lockMu.Unlock()
+	if p.users == 0 {
+		return // closed since
+	}
+	if p.users--; p.users == 0 && p.lock != lockExclusive {
+		p.unlockIdle()
+	}
+}
+
+// unlockIdle gives up the locks once nothing reads the file, keeping the
+// reserved one while the cache holds changes. p.lockMu must be held.
+func (p *Pager) unlockIdle() {
+	if p.fileDescriptor != nil {
+		unlockFile(p.fileDescriptor)
+	}
+	if p.lock == lockReserved && p.isDirty() {
+		return
+	}
+	if p.lockFile != nil {
+		p.lockFile.Close()
+		p.lockFile = nil
+	}
+	p.lock = lockNone
+}
+
+// reopenIfReplaced checks, with the file locked, that it is still the one at
+// its path. A vacuum in another process renames a new file over it, and a
+// lock waited for may then have been taken on the old one. In that case the
+// lock is given up, the new file opened in place of the old one and true
+// returned, for the lock to be taken again. A file removed from its path is
+// left alone.
+func (p *Pager) reopenIfReplaced() (bool, error) {
+	fd := p.fileDescriptor
+	locked, err := fd.Stat()
+	if err != nil {
+		unlockFile(fd)
+		return false, fmt.Errorf("unable to get file info: %w", err)
+	}
+	current, err := os.Stat(fd.Name())
+	if err != nil || os.SameFile(locked, current) {
+		return false, nil
+	}
+	unlockFile(fd)
+	flag := os.O_RDWR
+	if p.readOnly {
+		flag = os.O_RDONLY
+	}
+	newFd, err := os.OpenFile(fd.Name(), flag, 0)
+	if err != nil {
+		return false, fmt.Errorf("unable to open file: %w", err)
+	}
+	return true, p.useFile(newFd)
+}
+
+// revalidate drops the cache if the file changed since it was filled, as the
+// change counter in the meta page and the size of the file tell, and reports
+// whether it did.
+func (p *Pager) revalidate() (bool, error) {
+	size, err := p.storage.Size()
+	if err != nil {
+		return false, fmt.Errorf("unable to get file info: %w", err)
+	}
+	if size%int64(PageSize) != 0 {
+		return false, fmt.Errorf("%w: db file is not a whole number of pages", ErrCorrupt)
+	}
+	numPages := uint32_t(size / int64(PageSize))
+	var counter uint32_t
+	if numPages > 0 {
+		var page [PageSize]byte
+		if err := p.storage.ReadPage(uint32(MetaPageNum), page[:]); err != nil {
+			return false, fmt.Errorf("error reading page %d: %w", MetaPageNum, err)
+		}
+		counter = (*MetaPageBody)(unsafe.Pointer(&page[PageHeaderSize])).changeCounter
+	}
+	if numPages == p.numPages && counter == p.changeCounter {
+		return false, nil
+	}
+	p.resetCache(numPages)
+	p.changeCounter = counter
+	return true, nil
+}
+
+// reserve takes the reserved lock before the first change, under a shared
+// one. It is kept until the changes have been written back to the file. A
+// read-only pager never takes it, so it never writes to the file either.
+func (p *Pager) reserve() error {
+	if p.base != nil {
+		return p.base.reserve()
+	}
+	if p.readOnly {
+		return ErrReadOnly
+	}
+	p.lockMu.Lock()
+	defer p.lockMu.Unlock()
+	if p.lock >= lockReserved {
+		return nil
+	} else if p.fileDescriptor == nil {
+		p.lock = lockReserved
+		p.writeFresh()
+		return nil
+	}
+	lockFile, err := os.OpenFile(p.fileDescriptor.Name()+"-lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := p.retry(func() (bool, error) { return tryLockFile(lockFile, true) }); err != nil {
+		lockFile.Close()
+		return err
+	}
+	p.lockFile = lockFile
+	p.lock = lockReserved
+	p.writeFresh()
+	return nil
+}
+
+// lockExclusive takes the exclusive lock before writing to the file. Only
+// the holder of the reserved lock gets here, so while a shared lock is given
+// up in between tries no other process can take the exclusive lock.
+func (p *Pager) lockExclusive() error {
+	p.lockMu.Lock()
+	defer p.lockMu.Unlock()
+	err := p.retry(func() (bool, error) {
+		ok, err := p.tryLock(true)
+		if err == nil && !ok && p.users > 0 {
+			// a failed upgrade may have dropped the shared lock
+			_, err = p.tryLock(false)
+		}
+		return ok, err
+	})
+	if err != nil {
+		return err
+	}
+	p.lock = lockExclusive
+	return nil
+}
+
+// unlockExclusive goes back from the exclusive lock to the reserved one once
+// the cache has been written back, or gives up both if nothing reads the file
+// and nothing is left to write.
+func (p *Pager) unlockExclusive() {
+	p.lockMu.Lock()
+	defer p.lockMu.Unlock()
+	if p.lock != lockExclusive {
+		return
+	}
+	p.lock = lockReserved
+	if p.users == 0 {
+		p.unlockIdle()
+		return
+	}
+	// nobody else holds a lock to wait for
+	p.tryLock(false)
+}
+
+// unlock gives up all locks.
+func (p *Pager) unlock() {
+	p.lockMu.Lock()
+	defer p.lockMu.Unlock()
+	if p.lockFile != nil {
+		p.lockFile.Close()
+		p.lockFile = nil
+	}
+	if p.fileDescriptor != nil {
+		unlockFile(p.fileDescriptor)
+	}
+	p.users = 0
+	p.lock = lockNone
+}
+
+// tryLock locks the database file. An in-memory database has no file and no
+// other process to share it with.
+func (p *Pager) tryLock(exclusive bool) (bool, error) {
+	if p.fileDescriptor == nil {
+		return true, nil
+	}
+	return tryLockFile(p.fileDescriptor, exclusive)
+}
+
+// retry calls try until it succeeds, fails or the busy timeout runs out, in
+// which case it returns ErrLocked.
+func (p *Pager) retry(try func() (bool, error)) error {
+	deadline := time.Now().Add(p.busyTimeout)
+	for {
+		ok, err := try()
+		if err != nil {
+			return err
+		} else if ok {
+			return nil
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return ErrLocked
+		}
+		if wait > 10*time.Millisecond {
+			wait = 10 * time.Millisecond
+		}
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,414 @@
+package db
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLockHelperProcess is not a test. The lock tests run it in a child
+// process, which opens LOCK_HELPER_PATH and does LOCK_HELPER_ACTION:
+//
+//	insert  insert a row and close
+//	hold    begin a read transaction, print "ready" and end it and close
+//	        when stdin closes
+//	idle    print the number of rows, and again when stdin closes, and close
+func TestLockHelperProcess(t *testing.T) {
+	action := os.Getenv("LOCK_HELPER_ACTION")
+	if action == "" {
+		return
+	}
+	db, err := Open(os.Getenv("LOCK_HELPER_PATH"), &Options{BusyTimeout: 50 * time.Millisecond})
+	if err == nil && action == "insert" {
+		err = db.Exec("insert 100 child child@example.com")
+	}
+	if err == nil && action == "hold" {
+		var tx *Tx
+		if tx, err = db.BeginRead(); err == nil {
+			fmt.Println("ready")
+			io.Copy(io.Discard, os.Stdin)
+			err = tx.Rollback()
+		}
+	}
+	if err == nil && action == "idle" {
+		var n int
+		if n, err = countRows(db); err == nil {
+			fmt.Println(n, "rows")
+			io.Copy(io.Discard, os.Stdin)
+			n, err = countRows(db)
+			fmt.Println(n, "rows")
+		}
+	}
+	if err == nil {
+		err = db.Close()
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+	os.Exit(0)
+}
+
+func countRows(db *DB) (int, error) {
+	rows, err := db.Query("select")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	return n, rows.Err()
+}
+
+type lockHelper struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func startLockHelper(t *testing.T, path, action string) *lockHelper {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("database files are not locked on windows")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelperProcess$")
+	cmd.Env = append(os.Environ(), "LOCK_HELPER_ACTION="+action, "LOCK_HELPER_PATH="+path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	h := &lockHelper{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}
+	t.Cleanup(func() {
+		h.stdin.Close()
+		h.cmd.Wait()
+	})
+	return h
+}
+
+func (h *lockHelper) readLine(t *testing.T) string {
+	t.Helper()
+	line, err := h.stdout.ReadString('\n')
+	if err != nil {
+		t.Fatalf("helper process: %v", err)
+	}
+	return strings.TrimSpace(line)
+}
+
+// finish closes the helper's stdin and returns its last line of output.
+func (h *lockHelper) finish(t *testing.T) string {
+	t.Helper()
+	h.stdin.Close()
+	line := h.readLine(t)
+	h.cmd.Wait()
+	return line
+}
+
+func TestLockWriterExcludesOtherWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("insert 1 parent parent@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	child := startLockHelper(t, path, "insert")
+	if got := child.finish(t); got != ErrLocked.Error() {
+		t.Errorf("child inserting while the parent writes: got %q, want %q", got, ErrLocked)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	child = startLockHelper(t, path, "insert")
+	if got := child.finish(t); got != "ok" {
+		t.Errorf("child inserting after the parent closed: got %q", got)
+	}
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, id := range []uint32{1, 100} {
+		if _, err := db.Get(id); err != nil {
+			t.Errorf("Get(%d): %v", id, err)
+		}
+	}
+}
+
+func TestLockWriterHeldUntilFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Exec("insert 1 parent parent@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// committed, but not written back
+	child := startLockHelper(t, path, "insert")
+	if got := child.finish(t); got != ErrLocked.Error() {
+		t.Errorf("child inserting after the parent committed: got %q, want %q", got, ErrLocked)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	child = startLockHelper(t, path, "insert")
+	if got := child.finish(t); got != "ok" {
+		t.Errorf("child inserting after the parent flushed: got %q", got)
+	}
+	if _, err := db.Get(100); err != nil {
+		t.Errorf("Get of the child's row: %v", err)
+	}
+	if err := db.Exec("insert 2 parent parent@example.com"); err != nil {
+		t.Errorf("inserting after the child wrote: %v", err)
+	}
+}
+
+func TestLockReaderDelaysWriterClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, &Options{BusyTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	child := startLockHelper(t, path, "hold")
+	if got := child.readLine(t); got != "ready" {
+		t.Fatalf("child: %q", got)
+	}
+	db, err = Open(path, &Options{BusyTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("insert 1 parent parent@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); !errors.Is(err, ErrLocked) {
+		t.Fatalf("Close while a reader has the file open: err = %v, want ErrLocked", err)
+	}
+	// still open, and still the only writer
+	if err := db.Exec("insert 2 parent parent@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := child.finish(t); got != "ok" {
+		t.Errorf("child: %q", got)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, id := range []uint32{1, 2} {
+		if _, err := db.Get(id); err != nil {
+			t.Errorf("Get(%d): %v", id, err)
+		}
+	}
+}
+
+func TestLockIdleReaderDoesNotBlockWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("insert 1 parent parent@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	child := startLockHelper(t, path, "idle")
+	if got := child.readLine(t); got != "1 rows" {
+		t.Fatalf("child: %q", got)
+	}
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("insert 2 parent parent@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close while another process has the file open: %v", err)
+	}
+	// the child's cache is dropped once it sees the file changed
+	child.stdin.Close()
+	if got := child.readLine(t); got != "2 rows" {
+		t.Errorf("child after the parent wrote: %q, want 2 rows", got)
+	}
+	if got := child.readLine(t); got != "ok" {
+		t.Errorf("child: %q", got)
+	}
+
+	child = startLockHelper(t, path, "idle")
+	if got := child.readLine(t); got != "2 rows" {
+		t.Fatalf("child: %q", got)
+	}
+	out := captureStdout(t, func() {
+		if code := RunShell(path, &ShellOptions{Commands: []string{"insert 3 shell shell@example.com"}}); code != ExitSuccess {
+			t.Errorf("RunShell returned %d", code)
+		}
+	})
+	if out != "Executed.\nTable freed.\n" {
+		t.Errorf("shell printed %q", out)
+	}
+	child.stdin.Close()
+	if got := child.readLine(t); got != "3 rows" {
+		t.Errorf("child after the shell wrote: %q, want 3 rows", got)
+	}
+}
+
+func TestLockBusyTimeoutWaits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, &Options{BusyTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("insert 1 parent parent@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	child := startLockHelper(t, path, "hold")
+	if got := child.readLine(t); got != "ready" {
+		t.Fatalf("child: %q", got)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		child.stdin.Close()
+	}()
+
+	start := time.Now()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Close took %v, it should have waited for the reader", elapsed)
+	}
+}
+
+func TestLockFileReplacedByVacuum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("insert 1 parent parent@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	child := startLockHelper(t, path, "idle")
+	if got := child.readLine(t); got != "1 rows" {
+		t.Fatalf("child: %q", got)
+	}
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("insert 2 parent parent@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the child still has the file the vacuum replaced open
+	child.stdin.Close()
+	if got := child.readLine(t); got != "2 rows" {
+		t.Errorf("child after the parent vacuumed: %q, want 2 rows", got)
+	}
+	if got := child.readLine(t); got != "ok" {
+		t.Errorf("child: %q", got)
+	}
+}
+
+func TestLockEmptyFileOpensWithoutReserving(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	writer, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	tx, err := writer.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Exec("insert 1 writer writer@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the writer holds the reserved lock and has written nothing yet
+	for _, opts := range []*Options{{ReadOnly: true}, {}} {
+		reader, err := Open(path, opts)
+		if err != nil {
+			t.Fatalf("Open with ReadOnly %v: %v", opts.ReadOnly, err)
+		}
+		if n, err := countRows(reader); err != nil || n != 0 {
+			t.Errorf("ReadOnly %v: %d rows, %v; want an empty database", opts.ReadOnly, n, err)
+		}
+		if err := reader.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Fatalf("readers wrote to the empty file: %v, %v", info.Size(), err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := Open(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if n, err := countRows(reader); err != nil || n != 1 {
+		t.Errorf("after the writer flushed: %d rows, %v; want 1", n, err)
+	}
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+/* Meta Page Layout */
+const (
+	MetaPageNum  uint32_t = 0
+	MetaMagic    uint32_t = 0x44425455 // "DBTU"
+	MetaVersion  uint32_t = 1
+	MetaPageSize          = uint32_t(unsafe.Sizeof(MetaPageBody{}))
+)
+
+// MetaPageBody is the body of page 0. It records where every tree of the
+// database starts and which pages are free for reuse.
+type MetaPageBody struct {
+	magic     uint32_t
+	version   uint32_t
+	pageSize  uint32_t
+	tableRoot uint32_t // root of the rows table
+	kvRoot    uint32_t // root of the top level key/value bucket
+	freelist  uint32_t // first free page, 0 if there is none
+
+	changeCounter uint32_t // counts the times the file has been written to
+}
+
+// FreePageBody is the body of a page on the freelist.
+type FreePageBody struct {
+	next uint32_t
+}
+
+// initializeDatabase lays out an empty database: the meta page, followed by
+// the root leaves of the rows table and the key/value bucket.
+func (p *Pager) initializeDatabase() error {
+	meta, err := p.initializeMeta()
+	if err != nil {
+		return err
+	}
+	meta.tableRoot = MetaPageNum + 1
+	meta.kvRoot = MetaPageNum + 2
+
+	header, body, err := p.getPage(meta.tableRoot)
+	if err != nil {
+		return err
+	}
+	leafPage := LeafPage{header: header, body: (*LeafPageBody)(body)}
+	leafPage.setPageType(PageLeaf)
+	leafPage.initializeLeafNode()
+	leafPage.setNodeRoot(true)
+	p.markDirty(meta.tableRoot)
+
+	return p.writeKVNode(&kvNode{pageNum: meta.kvRoot, isLeaf: true})
+}
+
+// initializeFresh lays out an empty database in the cache, for storage that
+// is empty. The pages are not marked to be written back until reserve is
+// taken for the first change, so that a reader never writes them.
+func (p *Pager) initializeFresh() error {
+	if err := p.initializeDatabase(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.dirty {
+		p.dirty[i] = false
+	}
+	p.fresh = true
+	return nil
+}
+
+// writeFresh marks the pages initializeFresh laid out to be written back,
+// once the first change has reserved the storage.
+func (p *Pager) writeFresh() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.fresh {
+		return
+	}
+	for i := uint32_t(0); i < p.numPages; i++ {
+		p.dirty[i] = true
+	}
+	p.fresh = false
+}
+
+// initializeMeta sets up the meta page of a new database, for the caller to
+// lay out its trees and record their roots.
+func (p *Pager) initializeMeta() (*MetaPageBody, error) {
+	header, body, err := p.getPage(MetaPageNum)
+	if err != nil {
+		return nil, err
+	}
+	header.pageType = PageMeta
+	meta := (*MetaPageBody)(body)
+	*meta = MetaPageBody{magic: MetaMagic, version: MetaVersion, pageSize: PageSize}
+	p.markDirty(MetaPageNum)
+	return meta, nil
+}
+
+func (p *Pager) meta() (*MetaPageBody, error) {
+	header, body, err := p.getPage(MetaPageNum)
+	if err != nil {
+		return nil, err
+	}
+	meta := (*MetaPageBody)(body)
+	if header.pageType != PageMeta || meta.magic != MetaMagic {
+		if isOldRoot(header) {
+			return nil, ErrOldFormat
+		}
+		return nil, fmt.Errorf("%w: file is not a database", ErrCorrupt)
+	}
+	if meta.version != MetaVersion || meta.pageSize != PageSize {
+		return nil, fmt.Errorf("%w: unsupported version %d or page size %d", ErrCorrupt, meta.version, meta.pageSize)
+	}
+	return meta, nil
+}
+
+// allocatePage returns a page for the caller to initialize, reusing a page
+// from the freelist when there is one.
+func (p *Pager) allocatePage() (uint32_t, error) {
+	meta, err := p.meta()
+	if err != nil {
+		return 0, err
+	}
+	if meta.freelist == 0 {
+		pageNum := p.getUnusedPageNum()
+		if _, _, err := p.getPage(pageNum); err != nil {
+			return 0, err
+		}
+		return pageNum, nil
+	}
+	pageNum := meta.freelist
+	header, body, err := p.getPage(pageNum)
+	if err != nil {
+		return 0, err
+	}
+	if header.pageType != PageFree {
+		return 0, fmt.Errorf("%w: page %d on the freelist is not free", ErrCorrupt, pageNum)
+	}
+	meta.freelist = (*FreePageBody)(body).next
+	p.markDirty(MetaPageNum)
+	return pageNum, nil
+}
+
+// freePage puts a page on the freelist.
+func (p *Pager) freePage(pageNum uint32_t) error {
+	meta, err := p.meta()
+	if err != nil {
+		return err
+	}
+	header, body, err := p.getPage(pageNum)
+	if err != nil {
+		return err
+	}
+	*header = PageHeader{pageType: PageFree}
+	*(*[PageBodySize]byte)(body) = [PageBodySize]byte{}
+	(*FreePageBody)(body).next = meta.freelist
+	meta.freelist = pageNum
+	p.markDirty(pageNum)
+	p.markDirty(MetaPageNum)
+	return nil
+}
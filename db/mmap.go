@@ -0,0 +1,79 @@
+package db
+
+import (
+	"os"
+	"unsafe"
+)
+
+// mapping is a read-only memory mapping of the database file, which page
+// reads are served from without copying when Options.MMap is set.
+//
+// Pages in the cache point into the mapping, so it is never unmapped while the
+// file is open. When the file grows it is mapped again in full, and the old
+// mappings are kept alongside until close. Snapshots and transactions read
+// copies of mapped pages, taken under the cache lock that writeBack holds, so
+// that writing over the file never changes a page while they read it.
+type mapping struct {
+	file  *os.File
+	views [][]byte // every mapping made, the current one last
+}
+
+// page returns page pageNum as a slice of the mapping, or nil if it lies past
+// the end of the file.
+func (m *mapping) page(pageNum uint32_t) ([]byte, error) {
+	var data []byte
+	if len(m.views) > 0 {
+		data = m.views[len(m.views)-1]
+	}
+	end := int64(pageNum+1) * int64(PageSize)
+	if end > int64(len(data)) {
+		fileInfo, err := m.file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if end > fileInfo.Size() {
+			return nil, nil
+		}
+		data, err = mmapFile(m.file, fileInfo.Size())
+		if err != nil || data == nil {
+			return nil, err
+		}
+		m.views = append(m.views, data)
+	}
+	return data[end-int64(PageSize) : end], nil
+}
+
+// contains reports whether header points into the mapping.
+func (m *mapping) contains(header *PageHeader) bool {
+	ptr := uintptr(unsafe.Pointer(header))
+	for _, data := range m.views {
+		start := uintptr(unsafe.Pointer(&data[0]))
+		if ptr >= start && ptr < start+uintptr(len(data)) {
+			return true
+		}
+	}
+	return false
+}
+
+// unmapHistory copies the kept images of a page that point into the mapping
+// out of it, before the page is written over in the file.
+func (p *Pager) unmapHistory(pageNum uint32_t) {
+	for i, image := range p.history[pageNum] {
+		if p.mapping.contains(image.header) {
+			header := *image.header
+			body := *(*[PageBodySize]byte)(image.body)
+			p.history[pageNum][i].pageImage = pageImage{header: &header, body: unsafe.Pointer(&body)}
+		}
+	}
+}
+
+func (m *mapping) close() error {
+	var err error
+	for _, data := range m.views {
+		if e := munmapFile(data); err == nil {
+			err = e
+		}
+	}
+	m.views = nil
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package db
+
+import "os"
+
+// mmapFile maps nothing on systems without mmap, where pages are read from
+// the file instead.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, nil
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
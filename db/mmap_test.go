@@ -0,0 +1,263 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// fillTestDB creates a database at path holding rows rows.
+func fillTestDB(tb testing.TB, path string, rows int) {
+	tb.Helper()
+	db, err := Open(path, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := 1; i <= rows; i++ {
+		if err := tx.Exec(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		tb.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// scan reads every row and returns how many there are.
+func scan(tb testing.TB, db *DB) int {
+	tb.Helper()
+	rows, err := db.Query("select")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	n := 0
+	for rows.Next() {
+		n++
+		if row := rows.Row(); row.ID() != uint32(n) {
+			tb.Fatalf("row %d has id %d", n, row.ID())
+		}
+	}
+	if err := rows.Err(); err != nil {
+		tb.Fatal(err)
+	}
+	return n
+}
+
+func TestMMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	fillTestDB(t, path, 300)
+
+	db, err := Open(path, &Options{MMap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := scan(t, db); n != 300 {
+		t.Errorf("scan found %d rows, want 300", n)
+	}
+	for i := 301; i <= 600; i++ {
+		if err := db.Exec(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the shell changes pages in the cache in place
+	table, err := dbOpen(&path, &Options{MMap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.pager.reserve(); err != nil {
+		t.Fatal(err)
+	}
+	statement, err := prepare("insert 601 user601 user601@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := executeStatement(statement, table); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.dbClose(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, &Options{MMap: true, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n := scan(t, db); n != 601 {
+		t.Errorf("scan found %d rows, want 601", n)
+	}
+}
+
+func BenchmarkFullScan(b *testing.B) {
+	const rows = 5000
+	path := filepath.Join(b.TempDir(), "bench.db")
+	fillTestDB(b, path, rows)
+	for _, mmap := range []bool{false, true} {
+		name := "read"
+		if mmap {
+			name = "mmap"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				db, err := Open(path, &Options{MMap: mmap, ReadOnly: true})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n := scan(b, db); n != rows {
+					b.Fatalf("scan found %d rows, want %d", n, rows)
+				}
+				db.Close()
+			}
+		})
+	}
+}
+
+func TestMMapFlushKeepsSnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Put([]byte("key"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, &Options{MMap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx, err := db.BeginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	snapshot, err := tx.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the page is read from the mapping before it is replaced
+	if value, err := snapshot.Get([]byte("key")); err != nil || string(value) != "old" {
+		t.Fatalf("Get = %q, %v", value, err)
+	}
+	bucket, err = db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Put([]byte("key"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := snapshot.Get([]byte("key")); err != nil || string(value) != "old" {
+		t.Errorf("snapshot after flush: Get = %q, %v, want old", value, err)
+	}
+}
+
+func TestMMapSnapshotScanDuringFlushes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 300
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%03d", i))
+		if err := bucket.Put(keys[i], valueFor(keys[i], 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, &Options{MMap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx, err := db.BeginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	snapshot, err := tx.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		bucket, err := db.KV()
+		for round := 1; err == nil && round <= 20; round++ {
+			for _, key := range keys {
+				if err = bucket.Put(key, valueFor(key, round)); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = db.Flush()
+			}
+		}
+		done <- err
+	}()
+	mapping := db.table.pager.mapping
+	for scans := 0; ; scans++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if scans == 0 {
+				t.Error("no scan ran alongside the writes")
+			}
+			return
+		default:
+		}
+		count := 0
+		if err := snapshot.ForEach(func(key, value []byte) error {
+			count++
+			if err := checkPair(key, value); err != nil {
+				return err
+			}
+			if value[len(key)] != 0 {
+				return fmt.Errorf("snapshot saw %q from a later round", key)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if count != n {
+			t.Fatalf("snapshot has %d keys, want %d", count, n)
+		}
+		for pageNum, image := range tx.table.pager.mapped {
+			if mapping.contains(image.header) {
+				t.Fatalf("snapshot reads page %d from the mapping", pageNum)
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Synchronous is when a database syncs its file, making what was written to
+// it durable, as in SQLite's synchronous pragma. The settings are in order of
+// how often they sync. The zero value is SynchronousDefault, which stands for
+// SynchronousNormal.
+type Synchronous int
+
+const (
+	SynchronousDefault Synchronous = iota
+	// SynchronousOff never syncs, leaving it to the operating system. A crash
+	// of the machine may lose or tear changes already written back.
+	SynchronousOff
+	// SynchronousNormal syncs whenever changes are written back to the file,
+	// on Flush and Close and in the background.
+	SynchronousNormal
+	// SynchronousFull writes changes back and syncs on every commit.
+	SynchronousFull
+)
+
+func (s Synchronous) String() string {
+	switch s {
+	case SynchronousOff:
+		return "off"
+	case SynchronousNormal:
+		return "normal"
+	case SynchronousFull:
+		return "full"
+	}
+	return fmt.Sprintf("Synchronous(%d)", int(s))
+}
+
+// parseSynchronous reads a synchronous setting by name, or by number as in
+// SQLite.
+func parseSynchronous(value string) (Synchronous, bool) {
+	switch strings.ToLower(value) {
+	case "off", "0":
+		return SynchronousOff, true
+	case "normal", "1":
+		return SynchronousNormal, true
+	case "full", "2":
+		return SynchronousFull, true
+	}
+	return 0, false
+}
+
+// preparePragma parses "pragma name" and "pragma name = value".
+func preparePragma(buffer *string, statement *Statement) PrepareResult {
+	statement.sType = StatementPragma
+	name, value, set := strings.Cut((*buffer)[len("pragma"):], "=")
+	name = strings.TrimSpace(name)
+	value = strings.TrimSpace(value)
+	if name != "synchronous" || set && value == "" {
+		return PrepareSyntaxError
+	}
+	if set {
+		if _, ok := parseSynchronous(value); !ok {
+			return PrepareSyntaxError
+		}
+	}
+	statement.pragma = name
+	statement.pragmaValue = value
+	return PrepareSuccess
+}
+
+// executePragma changes the setting to the value given, or prints it.
+func (s *Statement) executePragma(table *Table) error {
+	pager := table.pager
+	if pager.base != nil {
+		pager = pager.base
+	}
+	if s.pragmaValue == "" {
+		fmt.Println(pager.syncMode())
+		return nil
+	}
+	synchronous, _ := parseSynchronous(s.pragmaValue)
+	pager.mu.Lock()
+	pager.synchronous = synchronous
+	pager.mu.Unlock()
+	return nil
+}
+
+// syncMode returns the pager's synchronous setting.
+func (p *Pager) syncMode() Synchronous {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.synchronous
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSynchronous(t *testing.T) {
+	for _, test := range []struct {
+		opts    *Options
+		pragma  string
+		flush   bool
+		durable bool
+	}{
+		{opts: &Options{}, durable: false},
+		{opts: &Options{}, flush: true, durable: true},
+		{opts: &Options{Synchronous: SynchronousFull}, durable: true},
+		{opts: &Options{}, pragma: "pragma synchronous = full", durable: true},
+		{opts: &Options{}, pragma: "pragma synchronous=2", durable: true},
+		{opts: &Options{Synchronous: SynchronousOff}, flush: true, durable: false},
+		{opts: &Options{Synchronous: SynchronousFull}, pragma: "pragma synchronous = OFF", flush: true, durable: false},
+	} {
+		mem := NewMemoryStorage()
+		s := NewFaultStorage(mem)
+		opts := *test.opts
+		opts.Storage = s
+		db, err := Open("sync", &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.pragma != "" {
+			if err := db.Exec(test.pragma); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Exec("insert 1 user1 user1@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if test.flush {
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.Crash()
+
+		size, _ := mem.Size()
+		if durable := size > 0; durable != test.durable {
+			t.Errorf("synchronous %v, %q, flush %v: durable = %v, want %v",
+				test.opts.Synchronous, test.pragma, test.flush, durable, test.durable)
+		}
+	}
+}
+
+func TestPragmaSyntax(t *testing.T) {
+	db, err := Open(MemoryPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, query := range []string{"pragma", "pragma nothing = 1", "pragma synchronous = sometimes", "pragma synchronous ="} {
+		if err := db.Exec(query); !errors.Is(err, ErrSyntax) {
+			t.Errorf("Exec(%q): err = %v, want ErrSyntax", query, err)
+		}
+	}
+	if err := db.Exec("pragma synchronous"); err != nil {
+		t.Errorf("Exec(pragma synchronous): %v", err)
+	}
+}
+
+func TestSynchronousDefault(t *testing.T) {
+	tests := []struct {
+		synchronous Synchronous
+		want        Synchronous
+	}{
+		{SynchronousDefault, SynchronousNormal},
+		{SynchronousOff, SynchronousOff},
+		{SynchronousNormal, SynchronousNormal},
+		{SynchronousFull, SynchronousFull},
+	}
+	for _, test := range tests {
+		db, err := Open(MemoryPath, &Options{Synchronous: test.synchronous})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := db.table.pager.syncMode(); got != test.want {
+			t.Errorf("Options.Synchronous %d: synchronous %v, want %v", test.synchronous, got, test.want)
+		}
+		db.Close()
+	}
+}
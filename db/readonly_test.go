@@ -0,0 +1,75 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("insert 1 user mail"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(1); err != nil {
+		t.Errorf("Get: %v", err)
+	}
+	if err := db.Exec("insert 2 user mail"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Exec: err = %v, want ErrReadOnly", err)
+	}
+	bucket, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Put([]byte("k"), []byte("v")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Put: err = %v, want ErrReadOnly", err)
+	}
+	if _, err := db.Begin(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Begin: err = %v, want ErrReadOnly", err)
+	}
+	tx, err := db.BeginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("the file changed while open read-only")
+	}
+}
+
+func TestReadOnlyDoesNotCreate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.db")
+	if db, err := Open(path, &Options{ReadOnly: true}); err == nil {
+		db.Close()
+		t.Fatal("opened a missing file read-only")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Stat: err = %v, want the file not to exist", err)
+	}
+}
@@ -0,0 +1,261 @@
+package db
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// resultSet is what a select returns, as the shell prints it: the names of
+// the columns and, one row at a time, their values as text.
+type resultSet struct {
+	columns []string
+	numeric []bool                   // whether each column holds numbers
+	next    func() ([]string, error) // the next row's values, nil after the last
+}
+
+// selectRows returns the rows of the table in id order, read from a cursor as
+// they are asked for.
+func selectRows(table *Table) (*resultSet, error) {
+	c, err := table.tableStart()
+	if err != nil {
+		return nil, err
+	}
+	var row Row
+	next := func() ([]string, error) {
+		if c.endOfTable {
+			return nil, nil
+		}
+		value, err := c.cursorValue()
+		if err != nil {
+			return nil, err
+		}
+		row.deSerializeRow(unsafe.Pointer(value))
+		if err := c.advance(); err != nil {
+			return nil, err
+		}
+		return []string{strconv.FormatUint(uint64(row.id), 10), row.Username(), row.Email()}, nil
+	}
+	return &resultSet{columns: columns, numeric: []bool{true, false, false}, next: next}, nil
+}
+
+// each calls fn with the values of every row left in the result set.
+func (rs *resultSet) each(fn func(values []string) error) error {
+	for {
+		values, err := rs.next()
+		if err != nil || values == nil {
+			return err
+		}
+		if err := fn(values); err != nil {
+			return err
+		}
+	}
+}
+
+// resultWriters write a result set in each output mode, with a header naming
+// the columns if headers is set. Modes that always name the columns, and the
+// list mode that never does, ignore it.
+var resultWriters = map[string]func(w io.Writer, rs *resultSet, headers bool) error{
+	"list":     writeList,
+	"csv":      writeCSV,
+	"table":    writeTable,
+	"json":     writeJSON,
+	"line":     writeLine,
+	"markdown": writeMarkdown,
+}
+
+// writeList writes each row as printRow does, "(1, name, email)".
+func writeList(w io.Writer, rs *resultSet, headers bool) error {
+	return rs.each(func(values []string) error {
+		for i := range values {
+			values[i] = displayText(values[i])
+		}
+		_, err := fmt.Fprintf(w, "(%s)\n", strings.Join(values, ", "))
+		return err
+	})
+}
+
+func writeCSV(w io.Writer, rs *resultSet, headers bool) error {
+	cw := csv.NewWriter(w)
+	if headers {
+		cw.Write(rs.columns)
+	}
+	err := rs.each(func(values []string) error {
+		return cw.Write(values)
+	})
+	cw.Flush()
+	if err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// writeJSON writes each row as a JSON object on a line of its own, with the
+// columns in order.
+func writeJSON(w io.Writer, rs *resultSet, headers bool) error {
+	return rs.each(func(values []string) error {
+		var b bytes.Buffer
+		b.WriteByte('{')
+		for i, value := range values {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			writeJSONString(&b, rs.columns[i])
+			b.WriteByte(':')
+			if rs.numeric[i] {
+				b.WriteString(value)
+			} else {
+				writeJSONString(&b, value)
+			}
+		}
+		b.WriteString("}\n")
+		_, err := w.Write(b.Bytes())
+		return err
+	})
+}
+
+func writeJSONString(b *bytes.Buffer, s string) {
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	b.Truncate(b.Len() - 1) // the newline Encode ends with
+}
+
+// writeLine writes each column of a row on a line of its own, "name = value",
+// with a blank line between rows.
+func writeLine(w io.Writer, rs *resultSet, headers bool) error {
+	width := 0
+	for _, column := range rs.columns {
+		if n := utf8.RuneCountInString(column); n > width {
+			width = n
+		}
+	}
+	first := true
+	return rs.each(func(values []string) error {
+		var b strings.Builder
+		if !first {
+			b.WriteByte('\n')
+		}
+		first = false
+		for i, value := range values {
+			fmt.Fprintf(&b, "%*s = %s\n", width, rs.columns[i], displayText(value))
+		}
+		_, err := io.WriteString(w, b.String())
+		return err
+	})
+}
+
+// writeMarkdown writes a GitHub flavoured Markdown table, which always has a
+// header.
+func writeMarkdown(w io.Writer, rs *resultSet, headers bool) error {
+	row := func(values []string) error {
+		var b strings.Builder
+		for _, value := range values {
+			b.WriteString("| ")
+			b.WriteString(strings.ReplaceAll(displayText(value), "|", `\|`))
+			b.WriteByte(' ')
+		}
+		b.WriteString("|\n")
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+	if err := row(rs.columns); err != nil {
+		return err
+	}
+	rule := make([]string, len(rs.columns))
+	for i := range rule {
+		rule[i] = "---"
+		if rs.numeric[i] {
+			rule[i] = "--:"
+		}
+	}
+	if _, err := fmt.Fprintf(w, "|%s|\n", strings.Join(rule, "|")); err != nil {
+		return err
+	}
+	return rs.each(row)
+}
+
+// writeTable writes the rows in a box, lined up in columns, numbers to the
+// right. It reads every row before writing any, to know how wide the columns
+// must be.
+func writeTable(w io.Writer, rs *resultSet, headers bool) error {
+	var rows [][]string
+	if headers {
+		rows = append(rows, rs.columns)
+	}
+	widths := make([]int, len(rs.columns))
+	err := rs.each(func(values []string) error {
+		for i := range values {
+			values[i] = displayText(values[i])
+		}
+		rows = append(rows, values)
+		return nil
+	})
+	if err != nil || len(rows) == 0 {
+		return err
+	}
+	for _, values := range rows {
+		for i, value := range values {
+			if n := utf8.RuneCountInString(value); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	var b strings.Builder
+	rule := func() {
+		for _, width := range widths {
+			b.WriteString("+" + strings.Repeat("-", width+2))
+		}
+		b.WriteString("+\n")
+	}
+	rule()
+	for r, values := range rows {
+		for i, value := range values {
+			pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(value))
+			if rs.numeric[i] && !(headers && r == 0) {
+				value = pad + value
+			} else {
+				value += pad
+			}
+			b.WriteString("| " + value + " ")
+		}
+		b.WriteString("|\n")
+		if headers && r == 0 {
+			rule()
+		}
+	}
+	rule()
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// displayText makes a value safe to print to a terminal, escaping control
+// characters and bytes that are not UTF-8 the way Go string literals do.
+func displayText(s string) string {
+	if utf8.ValidString(s) && strings.IndexFunc(s, func(r rune) bool { return !unicode.IsPrint(r) }) < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, `\x%02x`, s[i])
+		case unicode.IsPrint(r):
+			b.WriteRune(r)
+		default:
+			q := strconv.QuoteRune(r)
+			b.WriteString(q[1 : len(q)-1])
+		}
+		i += size
+	}
+	return b.String()
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testResults returns a result set of the given rows.
+func testResults(rows ...[]string) *resultSet {
+	next := func() ([]string, error) {
+		if len(rows) == 0 {
+			return nil, nil
+		}
+		values := append([]string(nil), rows[0]...)
+		rows = rows[1:]
+		return values, nil
+	}
+	return &resultSet{columns: columns, numeric: []bool{true, false, false}, next: next}
+}
+
+func TestResultWriters(t *testing.T) {
+	rows := [][]string{
+		{"1", "a", "a@example.com"},
+		{"12", "b|\"c\", d", "tab\there"},
+	}
+	tests := []struct {
+		mode    string
+		headers bool
+		want    string
+	}{
+		{"list", true, "(1, a, a@example.com)\n(12, b|\"c\", d, tab\\there)\n"},
+		{"csv", false, "1,a,a@example.com\n12,\"b|\"\"c\"\", d\",tab\there\n"},
+		{"csv", true, "id,username,email\n1,a,a@example.com\n12,\"b|\"\"c\"\", d\",tab\there\n"},
+		{"json", false, `{"id":1,"username":"a","email":"a@example.com"}` + "\n" +
+			`{"id":12,"username":"b|\"c\", d","email":"tab\there"}` + "\n"},
+		{"line", false, "      id = 1\nusername = a\n   email = a@example.com\n\n" +
+			"      id = 12\nusername = b|\"c\", d\n   email = tab\\there\n"},
+		{"markdown", false, "| id | username | email |\n|--:|---|---|\n" +
+			"| 1 | a | a@example.com |\n| 12 | b\\|\"c\", d | tab\\there |\n"},
+		{"table", false, "+----+----------+---------------+\n" +
+			"|  1 | a        | a@example.com |\n" +
+			"| 12 | b|\"c\", d | tab\\there     |\n" +
+			"+----+----------+---------------+\n"},
+		{"table", true, "+----+----------+---------------+\n" +
+			"| id | username | email         |\n" +
+			"+----+----------+---------------+\n" +
+			"|  1 | a        | a@example.com |\n" +
+			"| 12 | b|\"c\", d | tab\\there     |\n" +
+			"+----+----------+---------------+\n"},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := resultWriters[test.mode](&b, testResults(rows...), test.headers); err != nil {
+			t.Fatalf("%s: %v", test.mode, err)
+		}
+		if b.String() != test.want {
+			t.Errorf("%s mode, headers %v:\n%s\nwant:\n%s", test.mode, test.headers, b.String(), test.want)
+		}
+	}
+	for _, mode := range OutputModes {
+		if resultWriters[mode] == nil {
+			t.Errorf("no writer for output mode %s", mode)
+		}
+	}
+}
+
+func TestShellModes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	var code int
+	out := captureStdout(t, func() {
+		code = RunShell(path, &ShellOptions{Commands: []string{
+			"insert 1 a a@example.com",
+			"select",
+			".mode table",
+			".headers on",
+			"select",
+			".mode",
+		}})
+	})
+	if code != ExitSuccess {
+		t.Fatalf("exit code %d, output:\n%s", code, out)
+	}
+	want := "(1, a, a@example.com)\nExecuted.\n" +
+		"+----+----------+---------------+\n" +
+		"| id | username | email         |\n" +
+		"+----+----------+---------------+\n" +
+		"|  1 | a        | a@example.com |\n" +
+		"+----+----------+---------------+\n" +
+		"Executed.\ncurrent output mode: table\n"
+	if !strings.Contains(out, want) {
+		t.Errorf("output:\n%q\nwant it to hold:\n%q", out, want)
+	}
+
+	out = captureStdout(t, func() {
+		code = RunShell(path, &ShellOptions{Commands: []string{".mode xml"}})
+	})
+	if code != ExitFailure || !strings.Contains(out, "mode should be one of") {
+		t.Errorf("exit code %d for an unknown mode, output:\n%s", code, out)
+	}
+}
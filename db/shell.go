@@ -0,0 +1,693 @@
+package db
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// ShellOptions configures RunShell.
+type ShellOptions struct {
+	Options // how the database is opened
+
+	// Input is where commands are read from, os.Stdin if nil. Meta commands
+	// take a line each, statements run on until a semicolon.
+	Input io.Reader
+	// Prompt prints a prompt before each command, for someone typing them.
+	// Without prompts the shell runs a batch, which stops at the first
+	// command that fails.
+	Prompt bool
+	// Mode is how selected rows are printed, one of OutputModes; "list" by
+	// default. The .mode meta command changes it later.
+	Mode string
+	// Headers prints the names of the columns above the rows in the table
+	// and csv modes, as ".headers on" does.
+	Headers bool
+	// Commands are run as a batch in place of reading Input. Each is a meta
+	// command or statements, which need no semicolon at the end.
+	Commands []string
+	// HistoryFile keeps the lines typed at a terminal from one session to the
+	// next, for the arrow keys and Ctrl-R to bring back. None are kept if it
+	// is empty.
+	HistoryFile string
+}
+
+// DefaultHistoryFile returns the history file in the user's home directory,
+// or "" if there is none.
+func DefaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".db_tutorial_history")
+}
+
+// OutputModes are the values ShellOptions.Mode takes: "(1, name, email)"
+// lists, CSV, a table in a box, JSON objects one to a line, a line for each
+// column, and Markdown tables.
+var OutputModes = []string{"list", "csv", "table", "json", "line", "markdown"}
+
+// tableName is what the shell calls the rows table, the only one there is,
+// as in "select * from users".
+const tableName = "users"
+
+// metaCommands are the meta commands the shell knows, for completion.
+var metaCommands = []string{".backup", ".btree", ".bucket", ".constants", ".dump", ".exit", ".export", ".flush", ".headers", ".import", ".keys", ".kvs", ".load", ".mode", ".pages", ".read"}
+
+// maxReadDepth is how deeply .read commands may nest, reading files that
+// read files.
+const maxReadDepth = 16
+
+// replFlushInterval is how often the shell writes changes back to the file.
+const replFlushInterval = 5 * time.Second
+
+// shell runs meta commands and statements against an open table.
+type shell struct {
+	table   *Table
+	mu      sync.Mutex // held while a command runs, background flushes wait for it
+	closed  bool
+	mode    string
+	headers bool
+	reading int // how many .read commands are running
+}
+
+// Run starts an interactive shell on the database file and returns the exit
+// code once it is done.
+func Run(db string) int {
+	return RunShell(db, &ShellOptions{Prompt: true, HistoryFile: DefaultHistoryFile()})
+}
+
+// RunShell opens the database at path and runs commands on it until they run
+// out or one is .exit, then closes it. It returns the exit code for the
+// process, ExitFailure if the database could not be opened or closed or a
+// command in a batch failed.
+func RunShell(path string, opts *ShellOptions) int {
+	if path == "" {
+		fmt.Printf("Must supply a database filename.\n")
+		return ExitFailure
+	}
+	mode := opts.Mode
+	if mode == "" {
+		mode = "list"
+	}
+	if resultWriters[mode] == nil {
+		fmt.Printf("Error: unknown output mode %q.\n", mode)
+		return ExitFailure
+	}
+	table, err := dbOpen(&path, &opts.Options)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return ExitFailure
+	}
+	sh := &shell{table: table, mode: mode, headers: opts.Headers}
+
+	// changes are written back now and then, not only on exit, while the
+	// shell waits for input
+	stop := make(chan struct{})
+	defer close(stop)
+	go sh.flushEvery(replFlushInterval, stop)
+
+	if opts.Commands != nil {
+		for _, command := range opts.Commands {
+			commands := []string{command}
+			if !isMetaCommand(command) {
+				commands, _ = splitStatements(command + "\n;")
+			}
+			for _, command := range commands {
+				if done, code := sh.run(command, false); done {
+					return code
+				}
+			}
+		}
+		_, code := sh.run(".exit", false)
+		return code
+	}
+	var code int
+	pending, done, err := readCommands(readLines(opts), func(command string) bool {
+		done, c := sh.run(command, opts.Prompt)
+		code = c
+		return done
+	})
+	if done {
+		return code
+	}
+	// the end of the input is as good as .exit
+	if err != io.EOF {
+		fmt.Printf("Error: %s\n", err)
+	} else if opts.Prompt {
+		fmt.Println()
+	}
+	if pending != "" {
+		fmt.Printf("Error: incomplete statement '%s'.\n", strings.TrimSpace(pending))
+	}
+	_, code = sh.run(".exit", false)
+	if err != io.EOF || pending != "" {
+		return ExitFailure
+	}
+	return code
+}
+
+// readCommands reads lines with readLine and passes run the commands they
+// hold: meta commands, a line each, and statements, which run on until a
+// semicolon. It goes on until run reports that it is done, or until the
+// lines run out, and then returns the error that ended them along with the
+// start of a statement left unfinished. Ctrl-C drops that start.
+func readCommands(readLine func(first bool) (string, error), run func(command string) (done bool)) (pending string, done bool, err error) {
+	for {
+		line, err := readLine(pending == "")
+		if errors.Is(err, errInterrupted) {
+			pending = ""
+			continue
+		}
+		if err != nil && line == "" {
+			return pending, false, err
+		}
+		if pending == "" && isMetaCommand(line) {
+			if run(line) {
+				return "", true, nil
+			}
+			continue
+		}
+		var statements []string
+		statements, pending = splitStatements(pending + line)
+		for _, statement := range statements {
+			if run(statement) {
+				return pending, true, nil
+			}
+		}
+	}
+}
+
+// readLines returns a function reading the shell's input a line at a time,
+// after a prompt for a new command if first is set and for the rest of a
+// statement if not. Someone typing at a terminal gets to edit the line.
+func readLines(opts *ShellOptions) func(first bool) (string, error) {
+	promptFor := func(first bool) string {
+		if first {
+			return prompt
+		}
+		return continuationPrompt
+	}
+	if opts.Prompt && opts.Input == nil && isTerminal(int(os.Stdin.Fd())) {
+		editor := newLineEditor(os.Stdin, os.Stdout, int(os.Stdin.Fd()), opts.HistoryFile, completeShell)
+		return func(first bool) (string, error) {
+			return editor.readLine(promptFor(first))
+		}
+	}
+	input := opts.Input
+	if input == nil {
+		input = os.Stdin
+	}
+	reader := bufio.NewReader(input)
+	return func(first bool) (string, error) {
+		if opts.Prompt {
+			printPrompt(promptFor(first))
+		}
+		return reader.ReadString('\n')
+	}
+}
+
+// completeShell returns the words that could take the place of word, which
+// follows before on the line: meta commands and statement keywords to start
+// a line, the names of the table and its columns and pragma settings later.
+func completeShell(before, word string) []string {
+	var words []string
+	switch fields := strings.Fields(before); {
+	case len(fields) == 1 && fields[0] == ".mode":
+		words = OutputModes
+	case len(fields) == 1 && fields[0] == ".headers":
+		words = []string{"off", "on"}
+	case len(fields) > 0:
+		words = append([]string{"from", tableName, "synchronous"}, columns...)
+		for s := SynchronousOff; s <= SynchronousFull; s++ {
+			words = append(words, s.String())
+		}
+	case strings.HasPrefix(word, "."):
+		words = metaCommands
+	default:
+		words = []string{"insert", "pragma", "select", "vacuum"}
+	}
+	var matches []string
+	for _, w := range words {
+		if strings.HasPrefix(w, word) {
+			matches = append(matches, w)
+		}
+	}
+	return matches
+}
+
+// cutField returns the first field of s, which spaces separate, and the rest
+// of s after the spaces that follow it.
+func cutField(s string) (field, rest string) {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	if i := strings.IndexFunc(s, unicode.IsSpace); i >= 0 {
+		return s[:i], strings.TrimLeftFunc(s[i:], unicode.IsSpace)
+	}
+	return s, ""
+}
+
+func isMetaCommand(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), ".")
+}
+
+// splitStatements returns the statements in text that a semicolon ends, and
+// what follows the last of them, the start of another statement. Semicolons
+// in quoted strings do not end statements, and comments from -- to the end
+// of the line are dropped. A comment starts a line or follows a space or a
+// semicolon; -- within a word is part of it.
+func splitStatements(text string) (statements []string, rest string) {
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '\'':
+			quoted = !quoted
+			b.WriteByte(c)
+		case quoted:
+			b.WriteByte(c)
+		case c == ';':
+			if statement := strings.TrimSpace(b.String()); statement != "" {
+				statements = append(statements, statement)
+			}
+			b.Reset()
+		case strings.HasPrefix(text[i:], "--") && (i == 0 || text[i-1] == ';' || unicode.IsSpace(rune(text[i-1]))):
+			end := strings.IndexByte(text[i:], '\n')
+			if end < 0 {
+				end = len(text) - i
+			}
+			i += end - 1 // up to the newline, which is kept
+		default:
+			b.WriteByte(c)
+		}
+	}
+	rest = b.String()
+	if strings.TrimSpace(rest) == "" {
+		rest = ""
+	}
+	return statements, rest
+}
+
+// run runs one line of input. It reports whether the shell is done, and with
+// what exit code: after .exit, and after a failed command unless interactive.
+func (sh *shell) run(line string, interactive bool) (done bool, code int) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return false, ExitSuccess
+	}
+	if line == ".exit" {
+		err := sh.close()
+		if errors.Is(err, ErrLocked) && interactive {
+			fmt.Printf("Error: %s, try again once the other connections are done reading.\n", err)
+			return false, ExitSuccess
+		} else if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			return true, ExitFailure
+		}
+		return true, ExitSuccess
+	}
+	ok := false
+	if err := sh.table.lockShared(); err != nil {
+		fmt.Printf("Error: %s\n", err)
+	} else {
+		ok = sh.execute(line)
+		sh.table.pager.unlockShared()
+	}
+	if !ok && !interactive {
+		if err := sh.close(); err != nil {
+			fmt.Printf("Error: %s\n", err)
+		}
+		return true, ExitFailure
+	}
+	return false, ExitSuccess
+}
+
+// close writes the database back and closes it. It stays open if others keep
+// it from being written back.
+func (sh *shell) close() error {
+	err := sh.table.dbClose()
+	if errors.Is(err, ErrLocked) {
+		return err
+	}
+	sh.closed = true
+	if err == nil {
+		sh.table.free()
+	}
+	return err
+}
+
+// execute runs a meta command or a statement, printing what it does, and
+// reports whether it succeeded.
+func (sh *shell) execute(line string) bool {
+	inputBuffer := &InputBuffer{buffer: []byte(line)}
+	table := sh.table
+	if line[0] == '.' {
+		switch sh.doMetaCommand(line) {
+		case MetaCommandSuccess:
+			return true
+		case MetaCommandFailure:
+			return false
+		case MetaCommandUnrecognizedCommand:
+			fmt.Printf("Unrecognized command '%s'\n", line)
+			return false
+		}
+	}
+
+	var statement Statement
+
+	switch prepareStatement(inputBuffer, &statement) {
+	case PrepareSuccess:
+	case PrepareSyntaxError:
+		fmt.Printf("Syntax error. Could not parse statement.\n")
+		return false
+	case PrepareStringTooLong:
+		fmt.Println(" String is too long.")
+		return false
+	case PrepareNegativeId:
+		fmt.Println("ID must be positive.")
+		return false
+	case PrepareUnrecognizedStatement:
+		fmt.Printf("Unrecognized keyword at start of '%s'.\n", line)
+		return false
+	}
+
+	var err error
+	if statement.sType == StatementInsert {
+		err = table.pager.reserve()
+	}
+	switch {
+	case err != nil:
+	case statement.sType == StatementSelect:
+		err = sh.printResult(table)
+	case statement.sType == StatementVacuum:
+		var reclaimed int64
+		if reclaimed, err = table.vacuum(); err == nil {
+			fmt.Printf("Reclaimed %d bytes.\n", reclaimed)
+		}
+	default:
+		err = executeStatement(&statement, table)
+	}
+	if err == nil && statement.sType == StatementInsert && table.pager.syncMode() == SynchronousFull {
+		err = table.pager.writeBack()
+	}
+	switch {
+	case err == nil:
+		fmt.Println("Executed.")
+	case errors.Is(err, ErrTableFull):
+		fmt.Println("Error: Table full.")
+	case errors.Is(err, ErrDuplicateKey):
+		fmt.Println("Error: Duplicate key.")
+	default:
+		fmt.Printf("Error: %s\n", err)
+	}
+	return err == nil
+}
+
+// doMetaCommand runs the meta commands that change how the shell itself
+// works, and leaves the others to doMetaCommand.
+func (sh *shell) doMetaCommand(line string) MetaCommandResult {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case ".mode":
+		if len(fields) == 1 {
+			fmt.Printf("current output mode: %s\n", sh.mode)
+			return MetaCommandSuccess
+		}
+		if len(fields) != 2 || resultWriters[fields[1]] == nil {
+			fmt.Printf("Error: mode should be one of: %s\n", strings.Join(OutputModes, " "))
+			return MetaCommandFailure
+		}
+		sh.mode = fields[1]
+	case ".headers":
+		if len(fields) != 2 || fields[1] != "on" && fields[1] != "off" {
+			fmt.Println("Usage: .headers on|off")
+			return MetaCommandFailure
+		}
+		sh.headers = fields[1] == "on"
+	case ".import":
+		if len(fields) != 3 {
+			fmt.Println("Usage: .import FILE TABLE")
+			return MetaCommandFailure
+		}
+		return sh.importFile(fields[1], fields[2])
+	case ".load":
+		fill := 1.0
+		var err error
+		if len(fields) == 4 {
+			if fill, err = strconv.ParseFloat(fields[3], 64); err == nil {
+				fill, err = fillFactor(fill)
+			}
+		}
+		if len(fields) != 3 && len(fields) != 4 || err != nil {
+			fmt.Println("Usage: .load FILE TABLE [FILLFACTOR]")
+			return MetaCommandFailure
+		}
+		return sh.loadFile(fields[1], fields[2], fill)
+	case ".export":
+		if len(fields) < 3 {
+			fmt.Println("Usage: .export FILE [csv|json] SELECT")
+			return MetaCommandFailure
+		}
+		_, rest := cutField(line)
+		path, rest := cutField(rest)
+		format, query := cutField(rest)
+		if format != "csv" && format != "json" {
+			format, query = exportFormat(path), rest
+		}
+		return sh.exportFile(path, format, query)
+	case ".dump":
+		if len(fields) > 2 {
+			fmt.Println("Usage: .dump [FILE]")
+			return MetaCommandFailure
+		}
+		return sh.dump(fields[1:])
+	case ".bucket":
+		err := runBucketCommand(sh.table, fields[1:])
+		if err == nil && sh.table.pager.syncMode() == SynchronousFull {
+			err = sh.table.pager.writeBack()
+		}
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			return MetaCommandFailure
+		}
+	case ".read":
+		if len(fields) != 2 {
+			fmt.Println("Usage: .read FILE")
+			return MetaCommandFailure
+		}
+		return sh.readFile(fields[1])
+	case ".backup":
+		if len(fields) != 2 {
+			fmt.Println("Usage: .backup FILE")
+			return MetaCommandFailure
+		}
+		snapshot := sh.table.pager.snapshot()
+		defer snapshot.release()
+		if err := snapshot.saveTo(fields[1]); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			return MetaCommandFailure
+		}
+	default:
+		return doMetaCommand(&InputBuffer{buffer: []byte(line)}, sh.table)
+	}
+	return MetaCommandSuccess
+}
+
+// importFile imports the rows in a CSV or JSON lines file, see importRows,
+// and reports the records it left out. It fails if it left out any, though
+// it keeps the rest.
+func (sh *shell) importFile(path, table string) MetaCommandResult {
+	if table != tableName {
+		fmt.Printf("Error: no such table: %s\n", table)
+		return MetaCommandFailure
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return MetaCommandFailure
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	imported, rejected, err := importRows(sh.table, r, importFormat(path, r))
+	if err == nil && sh.table.pager.syncMode() == SynchronousFull {
+		err = sh.table.pager.writeBack()
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return MetaCommandFailure
+	}
+	for _, row := range rejected {
+		fmt.Printf("%s:%d: %s\n", path, row.line, row.reason)
+	}
+	fmt.Printf("Imported %d rows, rejected %d.\n", imported, len(rejected))
+	if len(rejected) > 0 {
+		return MetaCommandFailure
+	}
+	return MetaCommandSuccess
+}
+
+// loadFile loads the rows in a CSV or JSON lines file, see loadRecords, and
+// reports the records it left out as importFile does.
+func (sh *shell) loadFile(path, table string, fill float64) MetaCommandResult {
+	if table != tableName {
+		fmt.Printf("Error: no such table: %s\n", table)
+		return MetaCommandFailure
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return MetaCommandFailure
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	loaded, rejected, err := loadRecords(sh.table, r, importFormat(path, r), fill)
+	if err == nil && sh.table.pager.syncMode() == SynchronousFull {
+		err = sh.table.pager.writeBack()
+	}
+	switch {
+	case errors.Is(err, ErrDuplicateKey):
+		fmt.Printf("Error: %s, nothing loaded.\n", err)
+		return MetaCommandFailure
+	case err != nil:
+		fmt.Printf("Error: %s\n", err)
+		return MetaCommandFailure
+	}
+	for _, row := range rejected {
+		fmt.Printf("%s:%d: %s\n", path, row.line, row.reason)
+	}
+	fmt.Printf("Loaded %d rows, rejected %d.\n", loaded, len(rejected))
+	if len(rejected) > 0 {
+		return MetaCommandFailure
+	}
+	return MetaCommandSuccess
+}
+
+// exportFile writes the rows a select statement returns to a file, as CSV
+// with a header or as JSON objects one to a line. The rows are read from the
+// table as they are written, however many there are.
+func (sh *shell) exportFile(path, format, query string) MetaCommandResult {
+	var statement Statement
+	if prepareStatement(&InputBuffer{buffer: []byte(query)}, &statement) != PrepareSuccess || statement.sType != StatementSelect {
+		fmt.Printf("Error: .export needs a select statement, not '%s'.\n", query)
+		return MetaCommandFailure
+	}
+	n, err := exportRows(sh.table, path, format)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return MetaCommandFailure
+	}
+	fmt.Printf("Exported %d rows to %s.\n", n, path)
+	return MetaCommandSuccess
+}
+
+// dump writes the statements that recreate the database, see dumpDatabase, to
+// the file named in args or else to the output.
+func (sh *shell) dump(args []string) MetaCommandResult {
+	out := io.Writer(os.Stdout)
+	var f *os.File
+	if len(args) == 1 {
+		var err error
+		if f, err = os.Create(args[0]); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			return MetaCommandFailure
+		}
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	err := dumpDatabase(w, sh.table)
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	if f != nil {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return MetaCommandFailure
+	}
+	return MetaCommandSuccess
+}
+
+// readFile runs the commands in a file, as a batch that stops at the first
+// command that fails. A .exit in the file ends it early.
+func (sh *shell) readFile(path string) MetaCommandResult {
+	if sh.reading >= maxReadDepth {
+		fmt.Printf("Error: .read nested more than %d deep.\n", maxReadDepth)
+		return MetaCommandFailure
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("Error: %s\n", err)
+		return MetaCommandFailure
+	}
+	defer f.Close()
+	sh.reading++
+	defer func() { sh.reading-- }()
+
+	reader := bufio.NewReader(f)
+	failed := false
+	pending, _, err := readCommands(func(bool) (string, error) {
+		return reader.ReadString('\n')
+	}, func(command string) bool {
+		command = strings.TrimSpace(command)
+		if command == ".exit" {
+			return true
+		}
+		failed = command != "" && !sh.execute(command)
+		return failed
+	})
+	switch {
+	case failed:
+		return MetaCommandFailure
+	case err != nil && err != io.EOF:
+		fmt.Printf("Error: %s\n", err)
+		return MetaCommandFailure
+	case pending != "":
+		fmt.Printf("Error: incomplete statement '%s'.\n", strings.TrimSpace(pending))
+		return MetaCommandFailure
+	}
+	return MetaCommandSuccess
+}
+
+// printResult prints the rows of the table in the shell's output mode.
+func (sh *shell) printResult(table *Table) error {
+	rs, err := selectRows(table)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	err = resultWriters[sh.mode](w, rs, sh.headers)
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// flushEvery writes changes back every interval until stop is closed.
+func (sh *shell) flushEvery(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sh.mu.Lock()
+			if !sh.closed {
+				sh.table.pager.writeBack()
+			}
+			sh.mu.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
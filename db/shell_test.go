@@ -0,0 +1,95 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what fn prints.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	defer func() { os.Stdout = stdout }()
+	fn()
+	out, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestRunShellBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	var code int
+	out := captureStdout(t, func() {
+		code = RunShell(path, &ShellOptions{Commands: []string{"insert 1 a a@example.com", "insert 2 b b@example.com"}})
+	})
+	if code != ExitSuccess {
+		t.Fatalf("exit code %d, output:\n%s", code, out)
+	}
+
+	out = captureStdout(t, func() {
+		input := strings.NewReader("select;\n\ninsert 1 c c@example.com;\ninsert 3 c c@example.com;\n")
+		code = RunShell(path, &ShellOptions{Input: input, Mode: "csv"})
+	})
+	if code != ExitFailure {
+		t.Errorf("exit code %d after a failed insert, want %d", code, ExitFailure)
+	}
+	if !strings.HasPrefix(out, "1,a,a@example.com\n2,b,b@example.com\n") || strings.Contains(out, "db > ") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get(3); err != ErrNotFound {
+		t.Errorf("the batch went on after a failure: Get(3) err = %v", err)
+	}
+}
+
+func TestRunShellMultiLineStatements(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	var code int
+	out := captureStdout(t, func() {
+		input := strings.NewReader("insert 1\n  a a@example.com; insert 2 b b@example.com;\nselect\n;")
+		code = RunShell(path, &ShellOptions{Input: input, Prompt: true})
+	})
+	if code != ExitSuccess {
+		t.Fatalf("exit code %d, output:\n%s", code, out)
+	}
+	if strings.Count(out, "Executed.") != 3 || strings.Count(out, "   > ") != 2 || !strings.Contains(out, "(2, b") {
+		t.Errorf("unexpected output:\n%s", out)
+	}
+
+	out = captureStdout(t, func() {
+		code = RunShell(path, &ShellOptions{Input: strings.NewReader("insert 3 c c@example.com\n")})
+	})
+	if code != ExitFailure || !strings.Contains(out, "incomplete statement") {
+		t.Errorf("exit code %d for an unterminated statement, output:\n%s", code, out)
+	}
+}
+
+func TestRunShellComments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	var code int
+	out := captureStdout(t, func() {
+		input := strings.NewReader("-- a comment\ninsert 1 a--b a@x.com; -- another\ninsert 2 b b@x.com;-- and another\ninsert 3 c c@x.com --;\n;select;")
+		code = RunShell(path, &ShellOptions{Input: input})
+	})
+	if code != ExitSuccess {
+		t.Fatalf("exit code %d, output:\n%s", code, out)
+	}
+	if want := "(1, a--b, a@x.com)\n(2, b, b@x.com)\n(3, c, c@x.com)\n"; !strings.Contains(out, want) {
+		t.Errorf("output:\n%s\nwant the rows:\n%s", out, want)
+	}
+}
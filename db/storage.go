@@ -0,0 +1,214 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+)
+
+// MemoryPath is the name Open takes for a database that lives in memory. It
+// starts out empty and is gone when closed, unless saved with DB.SaveTo.
+const MemoryPath = ":memory:"
+
+// Storage is where a database keeps its pages between reading them into the
+// cache and writing them back. Pages are PageSize bytes, page n at byte offset
+// n*PageSize. Open uses a file, or memory for MemoryPath; Options.Storage
+// puts a database on any other.
+//
+// The database reads pages from one goroutine at a time and only writes them
+// once its transactions are over, but a Storage shared between databases must
+// do its own locking.
+type Storage interface {
+	// ReadPage fills page with page pageNum. Bytes past the end read as
+	// zeros.
+	ReadPage(pageNum uint32, page []byte) error
+	// WritePage writes page as page pageNum, growing the storage if need be.
+	WritePage(pageNum uint32, page []byte) error
+	// Sync makes what has been written durable.
+	Sync() error
+	// Size returns the size of the storage in bytes.
+	Size() (int64, error)
+	// Truncate changes the size of the storage.
+	Truncate(size int64) error
+	Close() error
+}
+
+// FileStorage keeps pages in a file.
+type FileStorage struct {
+	file *os.File
+}
+
+// NewFileStorage returns a Storage on file. A database opened on it with
+// Options.Storage takes no locks, so no other process may use the file.
+func NewFileStorage(file *os.File) *FileStorage {
+	return &FileStorage{file: file}
+}
+
+func (s *FileStorage) ReadPage(pageNum uint32, page []byte) error {
+	n, err := s.file.ReadAt(page, int64(pageNum)*int64(PageSize))
+	if err == io.EOF {
+		for i := n; i < len(page); i++ {
+			page[i] = 0
+		}
+		return nil
+	}
+	return err
+}
+
+func (s *FileStorage) WritePage(pageNum uint32, page []byte) error {
+	_, err := s.file.WriteAt(page, int64(pageNum)*int64(PageSize))
+	return err
+}
+
+func (s *FileStorage) Sync() error {
+	return s.file.Sync()
+}
+
+func (s *FileStorage) Size() (int64, error) {
+	fileInfo, err := s.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fileInfo.Size(), nil
+}
+
+func (s *FileStorage) Truncate(size int64) error {
+	return s.file.Truncate(size)
+}
+
+func (s *FileStorage) Close() error {
+	return s.file.Close()
+}
+
+// MemoryStorage keeps pages in memory. Closing it keeps them, so a database
+// closed on a MemoryStorage can be opened on it again.
+type MemoryStorage struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// NewMemoryStorage returns an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return new(MemoryStorage)
+}
+
+func (s *MemoryStorage) ReadPage(pageNum uint32, page []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	if offset := int64(pageNum) * int64(PageSize); offset < int64(len(s.data)) {
+		n = copy(page, s.data[offset:])
+	}
+	for i := n; i < len(page); i++ {
+		page[i] = 0
+	}
+	return nil
+}
+
+func (s *MemoryStorage) WritePage(pageNum uint32, page []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offset := int64(pageNum) * int64(PageSize)
+	if end := offset + int64(len(page)); end > int64(len(s.data)) {
+		s.resize(end)
+	}
+	copy(s.data[offset:], page)
+	return nil
+}
+
+func (s *MemoryStorage) Sync() error {
+	return nil
+}
+
+func (s *MemoryStorage) Size() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(len(s.data)), nil
+}
+
+func (s *MemoryStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resize(size)
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+// resize grows the data with zeros or cuts it short.
+func (s *MemoryStorage) resize(size int64) {
+	if size <= int64(len(s.data)) {
+		s.data = s.data[:size]
+		return
+	}
+	s.data = append(s.data, make([]byte, size-int64(len(s.data)))...)
+}
+
+// SaveTo writes a consistent copy of the database to a file at path, replacing
+// anything already there. It copies one snapshot, as BeginRead sees it, so
+// changes made while it runs are left out of the copy rather than torn, and
+// changes committed but not yet written back are in it. The shell's .backup
+// command does the same.
+//
+// It is how an in-memory database outlives its DB, but works for any.
+func (db *DB) SaveTo(path string) error {
+	tx, err := db.BeginRead()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return tx.table.pager.saveTo(path)
+}
+
+// saveTo writes the pages a snapshot sees to a new file, which then replaces
+// the one at path in a single rename, so that path never holds half a copy.
+// The directory is synced after the rename, so that the copy outlasts a crash.
+func (p *Pager) saveTo(path string) error {
+	if fd := p.base.fileDescriptor; fd != nil {
+		source, err := fd.Stat()
+		if err != nil {
+			return err
+		}
+		if target, err := os.Stat(path); err == nil && os.SameFile(source, target) {
+			return fmt.Errorf("db: can not save a database over its own file")
+		}
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to open file: %w", err)
+	}
+	target := NewFileStorage(file)
+	err = file.Chmod(0644)
+	for i := uint32_t(0); i < p.numPages && err == nil; i++ {
+		var header *PageHeader
+		var body unsafe.Pointer
+		header, body, err = p.getPage(i)
+		if err == nil {
+			err = target.WritePage(uint32(i), pageBytes(header, body))
+		}
+		if err != nil {
+			err = fmt.Errorf("error saving page %d: %w", i, err)
+		}
+	}
+	if err == nil {
+		err = target.Sync()
+	}
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
@@ -0,0 +1,189 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryDatabase(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	db, err := Open(MemoryPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := Open(MemoryPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const rows = 500
+	for i := 1; i <= rows; i++ {
+		if err := db.Exec(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bucket, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Put([]byte("key"), bytes.Repeat([]byte("v"), 3000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Get(1); err != ErrNotFound {
+		t.Errorf("other in-memory database: Get(1) err = %v, want ErrNotFound", err)
+	}
+	if err := other.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "saved.db")
+	if err := db.SaveTo(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %d files, want only the saved one", len(entries))
+	}
+
+	saved, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saved.Close()
+	rowsSeen := 0
+	cursor, err := saved.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ok := cursor.First(); ok; ok = cursor.Next() {
+		rowsSeen++
+		if row := cursor.Row(); row.ID() != uint32(rowsSeen) || row.Username() != fmt.Sprintf("user%d", rowsSeen) {
+			t.Fatalf("row %d = %d %s", rowsSeen, row.ID(), row.Username())
+		}
+	}
+	if err := cursor.Err(); err != nil || rowsSeen != rows {
+		t.Errorf("saved copy has %d rows, err %v, want %d", rowsSeen, err, rows)
+	}
+	bucket, err = saved.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := bucket.Get([]byte("key")); err != nil || len(value) != 3000 {
+		t.Errorf("saved copy: Get(key) = %d bytes, %v", len(value), err)
+	}
+	if err := saved.SaveTo(path); err == nil {
+		t.Error("SaveTo over the database's own file succeeded")
+	}
+}
+
+func TestFaultStorage(t *testing.T) {
+	mem := NewMemoryStorage()
+	s := NewFaultStorage(mem)
+	page := bytes.Repeat([]byte{1}, int(PageSize))
+	if err := s.WritePage(0, page); err != nil {
+		t.Fatal(err)
+	}
+	s.FailWrite(0, 10, io.ErrShortWrite)
+	if err := s.WritePage(1, bytes.Repeat([]byte{2}, int(PageSize))); err != io.ErrShortWrite {
+		t.Fatalf("short write: err = %v", err)
+	}
+	if size, _ := s.Size(); size != int64(PageSize)+10 {
+		t.Errorf("size after short write = %d, want %d", size, PageSize+10)
+	}
+	if size, _ := mem.Size(); size != 0 {
+		t.Errorf("unsynced writes reached the wrapped storage, size %d", size)
+	}
+	got := make([]byte, PageSize)
+	if err := s.ReadPage(1, got); err != nil || got[9] != 2 || got[10] != 0 {
+		t.Errorf("reading a short written page: %v %v", got[9:11], err)
+	}
+
+	s.FailSync(0, io.ErrClosedPipe)
+	if err := s.Sync(); err != io.ErrClosedPipe {
+		t.Fatalf("failed sync: err = %v", err)
+	}
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := mem.Size(); size != int64(PageSize)+10 {
+		t.Errorf("size after sync = %d, want %d", size, PageSize+10)
+	}
+
+	if err := s.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	s.Crash()
+	if err := s.ReadPage(0, got); err != ErrCrashed {
+		t.Errorf("read after crash: err = %v, want ErrCrashed", err)
+	}
+	if err := mem.ReadPage(0, got); err != nil || !bytes.Equal(got, page) {
+		t.Errorf("synced page lost in crash: %v", err)
+	}
+}
+
+func TestCrashLosesOnlyUnsyncedChanges(t *testing.T) {
+	mem := NewMemoryStorage()
+	db, err := Open("crash", &Options{Storage: NewFaultStorage(mem)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("insert 1 user1 user1@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash part way through writing back
+	s := NewFaultStorage(mem)
+	db, err = Open("crash", &Options{Storage: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 2; i <= 100; i++ {
+		if err := db.Exec(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.FailWrite(3, 100, io.ErrShortWrite)
+	if err := db.Close(); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("Close: err = %v, want a short write", err)
+	}
+	s.Crash()
+
+	s = NewFaultStorage(mem)
+	db, err = Open("crash", &Options{Storage: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get(1); err != nil {
+		t.Errorf("Get(1) after crash: %v", err)
+	}
+	if _, err := db.Get(2); err != ErrNotFound {
+		t.Errorf("Get(2) after crash: err = %v, want ErrNotFound", err)
+	}
+
+	errIO := errors.New("input/output error")
+	s.FailRead(0, errIO)
+	db.Close()
+	db, err = Open("crash", &Options{Storage: s})
+	if !errors.Is(err, errIO) {
+		t.Errorf("Open with a failing read: err = %v, want %v", err, errIO)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package db
+
+import "errors"
+
+// terminalState is empty on systems without termios, where the shell reads
+// whole lines as the terminal hands them over, without line editing.
+type terminalState struct{}
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (*terminalState, error) {
+	return nil, errors.New("raw terminal mode is not supported")
+}
+
+func restoreTerminal(fd int, state *terminalState) error {
+	return nil
+}
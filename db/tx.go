@@ -0,0 +1,452 @@
+package db
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"unsafe"
+)
+
+var (
+	// ErrTxDone is returned when using a transaction that has already been
+	// committed or rolled back.
+	ErrTxDone = errors.New("db: transaction has already been committed or rolled back")
+	// ErrTxReadOnly is returned when changing the database in a transaction
+	// started by BeginRead.
+	ErrTxReadOnly = errors.New("db: read-only transaction")
+)
+
+// pageImage is one version of a page. Once a page image is in the cache it is
+// never changed again, a transaction changes a copy and replaces the image
+// with it on commit, so snapshots can keep reading images that have since
+// been replaced.
+type pageImage struct {
+	header *PageHeader
+	body   unsafe.Pointer
+}
+
+// versionedImage is a page image that was current up to and including
+// version.
+type versionedImage struct {
+	version uint64
+	pageImage
+}
+
+// pageCopy is a transaction's private copy of a page.
+type pageCopy struct {
+	pageImage
+	original pageImage // the image it was copied from, nil for a new page
+	dirty    bool      // changed by the transaction
+}
+
+// writer returns a view of the pager for a transaction, which works on
+// private copies of the pages it fetches until commit. With latch set, the
+// view takes the latch of every page it changes, so that several of them can
+// insert rows at once.
+func (p *Pager) writer(latch bool) *Pager {
+	w := &Pager{base: p, pages: make(map[uint32_t]*pageCopy)}
+	if latch {
+		w.latched = make(map[uint32_t]*sync.Mutex)
+	}
+	return w
+}
+
+func (p *Pager) getPrivatePage(pageNum uint32_t) (*PageHeader, unsafe.Pointer, error) {
+	if c, ok := p.pages[pageNum]; ok {
+		return c.header, c.body, nil
+	}
+	base := p.base
+	base.mu.Lock()
+	if err := base.loadPage(pageNum); err != nil {
+		base.mu.Unlock()
+		return nil, nil, err
+	}
+	c := &pageCopy{original: pageImage{header: base.headers[pageNum], body: base.bodies[pageNum]}}
+	// copied under the lock, which writeBack holds while it writes over the
+	// file under a mapped page
+	header := *c.original.header
+	body := new([PageBodySize]byte)
+	copy(body[:], (*[PageBodySize]byte)(c.original.body)[:])
+	base.mu.Unlock()
+	c.header = &header
+	c.body = unsafe.Pointer(body)
+	p.pages[pageNum] = c
+	return c.header, c.body, nil
+}
+
+// getUnusedPageNum returns the number of a page past the end of the file for
+// the caller to initialize. A transaction reserves it right away, so that
+// transactions running at once never get the same page.
+func (p *Pager) getUnusedPageNum() uint32_t {
+	if p.base == nil {
+		return p.numPages
+	}
+	p.base.mu.Lock()
+	pageNum := p.base.numPages
+	p.base.numPages++
+	p.base.mu.Unlock()
+	p.pages[pageNum] = &pageCopy{pageImage: pageImage{header: new(PageHeader), body: unsafe.Pointer(new([PageBodySize]byte))}}
+	p.allocated = append(p.allocated, pageNum)
+	return pageNum
+}
+
+// setPage replaces a page with a new one built by the caller.
+func (p *Pager) setPage(pageNum uint32_t, header *PageHeader, body unsafe.Pointer) {
+	if c, ok := p.pages[pageNum]; ok {
+		c.header = header
+		c.body = body
+		c.dirty = true
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.headers[pageNum] = header
+	p.bodies[pageNum] = body
+	p.dirty[pageNum] = true
+}
+
+// latch takes the latch of a page before the transaction reads it with a mind
+// to change it, and keeps it until commit or rollback unless unlatchAllBut
+// gives it up earlier. Views without latches, and pages the transaction
+// allocated, need none.
+func (p *Pager) latch(pageNum uint32_t) {
+	if p.latched == nil {
+		return
+	}
+	if _, ok := p.latched[pageNum]; ok {
+		return
+	}
+	if c, ok := p.pages[pageNum]; ok && c.original.header == nil {
+		return
+	}
+	base := p.base
+	base.mu.Lock()
+	if base.latches == nil {
+		base.latches = make(map[uint32_t]*sync.Mutex)
+	}
+	latch, ok := base.latches[pageNum]
+	if !ok {
+		latch = new(sync.Mutex)
+		base.latches[pageNum] = latch
+	}
+	base.mu.Unlock()
+	latch.Lock()
+	p.latched[pageNum] = latch
+	// a copy taken before the latch was not changed, but may be stale by now
+	delete(p.pages, pageNum)
+}
+
+// unlatchAllBut gives up every latch except that of pageNum. Crabbing down
+// the tree calls it on reaching a page with room for one more cell, since a
+// split below can then go no further up.
+func (p *Pager) unlatchAllBut(pageNum uint32_t) {
+	for n, latch := range p.latched {
+		if n != pageNum {
+			latch.Unlock()
+			delete(p.latched, n)
+		}
+	}
+}
+
+// commit makes the transaction's changed pages current in one step. The
+// images they replace are kept for the snapshots that are still open.
+func (p *Pager) commit() {
+	base := p.base
+	base.mu.Lock()
+	for pageNum, c := range p.pages {
+		if !c.dirty {
+			continue // only read
+		}
+		base.growCache(pageNum)
+		base.dirty[pageNum] = true
+		if len(base.readers) > 0 && base.headers[pageNum] != nil {
+			if base.history == nil {
+				base.history = make(map[uint32_t][]versionedImage)
+			}
+			image := pageImage{header: base.headers[pageNum], body: base.bodies[pageNum]}
+			base.history[pageNum] = append(base.history[pageNum], versionedImage{version: base.version, pageImage: image})
+		}
+		base.headers[pageNum] = c.header
+		base.bodies[pageNum] = c.body
+	}
+	base.version++
+	base.mu.Unlock()
+	p.pages = nil
+	p.unlatchAllBut(math.MaxUint32)
+}
+
+// rollback drops the transaction's copies. Pages it allocated are given back
+// when no other transaction has allocated pages after them, and put on the
+// freelist when one has.
+func (p *Pager) rollback() {
+	base := p.base
+	base.mu.Lock()
+	i := len(p.allocated) - 1
+	for ; i >= 0 && p.allocated[i] == base.numPages-1; i-- {
+		base.numPages--
+	}
+	base.mu.Unlock()
+	if i >= 0 && p.freeAllocated(p.allocated[:i+1]) == nil {
+		p.commit()
+		return
+	}
+	p.pages = nil
+	p.unlatchAllBut(math.MaxUint32)
+}
+
+// freeAllocated drops the transaction's changes but for putting pages it
+// allocated on the freelist, for commit to make current. The meta page is
+// latched first, as transactions rolling back at once may all change it.
+func (p *Pager) freeAllocated(pageNums []uint32_t) error {
+	pages := make(map[uint32_t]*pageCopy, len(pageNums))
+	for _, pageNum := range pageNums {
+		pages[pageNum] = p.pages[pageNum]
+	}
+	p.pages = pages
+	p.latch(MetaPageNum)
+	for _, pageNum := range pageNums {
+		if err := p.freePage(pageNum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot returns a read-only pager that sees the pages as of the last
+// commit, whatever is committed after it. It must be released.
+func (p *Pager) snapshot() *Pager {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.readers == nil {
+		p.readers = make(map[uint64]int)
+	}
+	p.readers[p.version]++
+	return &Pager{base: p, version: p.version, numPages: p.numPages}
+}
+
+// release ends a snapshot and drops the page images no other snapshot needs.
+func (p *Pager) release() {
+	base := p.base
+	base.mu.Lock()
+	defer base.mu.Unlock()
+	if base.readers[p.version]--; base.readers[p.version] == 0 {
+		delete(base.readers, p.version)
+	}
+	if len(base.readers) == 0 {
+		base.history = nil
+		return
+	}
+	oldest := uint64(math.MaxUint64)
+	for version := range base.readers {
+		if version < oldest {
+			oldest = version
+		}
+	}
+	for pageNum, images := range base.history {
+		i := 0
+		for i < len(images) && images[i].version < oldest {
+			i++
+		}
+		if i == len(images) {
+			delete(base.history, pageNum)
+		} else {
+			base.history[pageNum] = images[i:]
+		}
+	}
+}
+
+// getSnapshotPage returns a page as the snapshot sees it. A page in the
+// mapping is copied out of it first and the copy kept, since writeBack may
+// write over the file under it while the snapshot still reads it.
+func (p *Pager) getSnapshotPage(pageNum uint32_t) (*PageHeader, unsafe.Pointer, error) {
+	if image, ok := p.mapped[pageNum]; ok {
+		return image.header, image.body, nil
+	}
+	image, mapped, err := p.base.getPageAt(p.version, pageNum)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mapped {
+		if p.mapped == nil {
+			p.mapped = make(map[uint32_t]pageImage)
+		}
+		p.mapped[pageNum] = image
+	}
+	return image.header, image.body, nil
+}
+
+// getPageAt returns a page as it was at version. The oldest image kept from
+// then on is that version of the page; without one the page has not been
+// committed since, and the cached image is. An image in the mapping is
+// returned as a copy, taken under the lock writeBack holds, and reported.
+func (p *Pager) getPageAt(version uint64, pageNum uint32_t) (image pageImage, mapped bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.loadPage(pageNum); err != nil {
+		return pageImage{}, false, err
+	}
+	image = pageImage{header: p.headers[pageNum], body: p.bodies[pageNum]}
+	for _, old := range p.history[pageNum] {
+		if old.version >= version {
+			image = old.pageImage
+			break
+		}
+	}
+	if p.mapping == nil || !p.mapping.contains(image.header) {
+		return image, false, nil
+	}
+	header := *image.header
+	body := new([PageBodySize]byte)
+	copy(body[:], (*[PageBodySize]byte)(image.body)[:])
+	return pageImage{header: &header, body: unsafe.Pointer(body)}, true, nil
+}
+
+func (t *Table) snapshot() *Table {
+	return &Table{rootPageNum: t.rootPageNum, pager: t.pager.snapshot()}
+}
+
+// Tx is an open transaction. Its changes become permanent on Commit and are
+// discarded on Rollback. Only one transaction that changes the database is
+// open at a time; Begin and DB.Exec wait for it. Readers do not, they keep
+// seeing the database as it was before the transaction until it commits.
+// A Tx must only be used by one goroutine, which must not start another
+// transaction that changes the database while it is open.
+type Tx struct {
+	db       *DB
+	done     bool
+	table    *Table // the transaction's view of the table
+	readOnly bool
+	shared   bool // only inserts rows, alongside other shared transactions
+}
+
+// Begin starts a transaction.
+func (db *DB) Begin() (*Tx, error) {
+	return db.begin(false)
+}
+
+// begin starts a transaction that changes the database. An exclusive one has
+// it to itself. A shared one only inserts rows, latching the pages it
+// changes, so that any number of them run at once.
+func (db *DB) begin(shared bool) (*Tx, error) {
+	if shared {
+		db.writer.RLock()
+	} else {
+		db.writer.Lock()
+	}
+	if db.table == nil {
+		db.unlockWriter(shared)
+		return nil, ErrClosed
+	}
+	if err := db.table.lockShared(); err != nil {
+		db.unlockWriter(shared)
+		return nil, err
+	}
+	if err := db.table.pager.reserve(); err != nil {
+		db.table.pager.unlockShared()
+		db.unlockWriter(shared)
+		return nil, err
+	}
+	table := &Table{rootPageNum: db.table.rootPageNum, pager: db.table.pager.writer(shared)}
+	return &Tx{db: db, table: table, shared: shared}, nil
+}
+
+func (db *DB) unlockWriter(shared bool) {
+	if shared {
+		db.writer.RUnlock()
+	} else {
+		db.writer.Unlock()
+	}
+}
+
+// BeginRead starts a read-only transaction. It sees the database as it was
+// when it began for as long as it is open, and neither waits for nor holds up
+// transactions that change the database. Pages those transactions replace are
+// kept until every read-only transaction that could see them has ended, so it
+// must be ended with Commit or Rollback like any other.
+func (db *DB) BeginRead() (*Tx, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.table == nil {
+		return nil, ErrClosed
+	}
+	if err := db.table.lockShared(); err != nil {
+		return nil, err
+	}
+	return &Tx{db: db, table: db.table.snapshot(), readOnly: true}, nil
+}
+
+// Exec runs a statement that does not return rows inside the transaction.
+func (tx *Tx) Exec(query string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	statement, err := prepare(query)
+	if err != nil {
+		return err
+	}
+	if statement.sType == StatementSelect {
+		return errSelectExec
+	}
+	if statement.sType == StatementPragma && statement.pragmaValue == "" {
+		return nil
+	}
+	if tx.readOnly && statement.sType != StatementPragma {
+		return ErrTxReadOnly
+	}
+	if statement.sType == StatementVacuum {
+		return errors.New("db: vacuum can not run inside a transaction")
+	}
+	return executeStatement(statement, tx.table)
+}
+
+// Query runs a select statement inside the transaction.
+func (tx *Tx) Query(query string) (*Rows, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	return tx.db.query(tx, query)
+}
+
+// Commit makes the transaction's changes permanent. Under SynchronousFull it
+// also writes them back to the file and syncs it; an error doing so is
+// returned, but the changes stay committed and are written back later.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if tx.readOnly {
+		tx.end()
+		return nil
+	}
+	tx.table.pager.commit()
+	tx.end()
+	if tx.table.pager.base.syncMode() == SynchronousFull {
+		return tx.db.Flush()
+	}
+	return nil
+}
+
+// Rollback discards the transaction's changes.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if !tx.readOnly {
+		tx.table.pager.rollback()
+	}
+	tx.end()
+	return nil
+}
+
+// end lets go of what the transaction held once it is done: its snapshot, or
+// the writer lock, and its share of the lock on the file.
+func (tx *Tx) end() {
+	if tx.readOnly {
+		tx.table.pager.release()
+	} else {
+		tx.db.unlockWriter(tx.shared)
+	}
+	tx.table.pager.base.unlockShared()
+}
@@ -0,0 +1,110 @@
+package db
+
+import "fmt"
+
+// oldLeafPageBody is the body of a leaf in the old layout, from before the
+// meta page, when a leaf linked to the next one only.
+type oldLeafPageBody struct {
+	nextLeaf uint32_t
+	cells    [LeafNodeMaxCells]LeafPageCell
+}
+
+// isOldRoot reports whether the header of page 0 is that of the root of the
+// rows table, which page 0 was in the old layout.
+func isOldRoot(header *PageHeader) bool {
+	return header.isRoot == 1 && (header.pageType == PageLeaf || header.pageType == PageInternal)
+}
+
+// upgrade converts a database in the old layout into the current one. Its
+// rows are copied into new pages, laid out as vacuum lays them out, which take
+// the place of the old ones.
+func (t *Table) upgrade() error {
+	p := t.pager
+	if err := p.reserve(); err != nil {
+		return err
+	}
+	if err := p.lockExclusive(); err != nil {
+		return err
+	}
+	defer p.unlockExclusive()
+
+	rows, err := p.oldRows(MetaPageNum, nil, 0)
+	if err != nil {
+		return err
+	}
+	return p.rebuild(func(rebuilt *Pager) error {
+		return rebuilt.copyRows(rows)
+	})
+}
+
+// oldRows appends to rows those under pageNum in the old layout, in id order.
+func (p *Pager) oldRows(pageNum uint32_t, rows []Row, depth uint32_t) ([]Row, error) {
+	// every level takes a page, so a deeper tree goes round in a cycle
+	if depth >= p.numPages {
+		return nil, fmt.Errorf("%w: page %d is its own descendant", ErrCorrupt, pageNum)
+	}
+	header, body, err := p.getPage(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	switch header.pageType {
+	case PageLeaf:
+		leaf := (*oldLeafPageBody)(body)
+		if header.numCells > LeafNodeMaxCells {
+			return nil, fmt.Errorf("%w: leaf %d has %d cells", ErrCorrupt, pageNum, header.numCells)
+		}
+		for i := uint32_t(0); i < header.numCells; i++ {
+			rows = append(rows, leaf.cells[i].value)
+		}
+		return rows, nil
+	case PageInternal:
+		internal := (*InternalPageBody)(body)
+		if header.numCells > InternalNodeMaxCells {
+			return nil, fmt.Errorf("%w: internal node %d has %d keys", ErrCorrupt, pageNum, header.numCells)
+		}
+		children := make([]uint32_t, 0, header.numCells+1)
+		for i := uint32_t(0); i < header.numCells; i++ {
+			children = append(children, internal.cells[i].value)
+		}
+		for _, child := range append(children, internal.rightChild) {
+			if child == 0 || child >= p.numPages {
+				return nil, fmt.Errorf("%w: internal node %d points to page %d", ErrCorrupt, pageNum, child)
+			}
+			if rows, err = p.oldRows(child, rows, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("%w: page %d is not a table node", ErrCorrupt, pageNum)
+}
+
+// copyRows lays out in p, which must be empty, a database holding rows, in
+// id order, and no key/value pairs.
+func (p *Pager) copyRows(rows []Row) error {
+	if _, err := p.initializeMeta(); err != nil {
+		return err
+	}
+	tableRoot, err := p.buildTable(func() (*Row, error) {
+		if len(rows) == 0 {
+			return nil, nil
+		}
+		row := &rows[0]
+		rows = rows[1:]
+		return row, nil
+	}, 1)
+	if err != nil {
+		return err
+	}
+	kvRoot := p.getUnusedPageNum()
+	if err := p.writeKVNode(&kvNode{pageNum: kvRoot, isLeaf: true}); err != nil {
+		return err
+	}
+	meta, err := p.meta()
+	if err != nil {
+		return err
+	}
+	meta.tableRoot = tableRoot
+	meta.kvRoot = kvRoot
+	return nil
+}
@@ -0,0 +1,142 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+)
+
+// oldPage is a page as the old layout wrote it.
+type oldPage struct {
+	header PageHeader
+	body   [PageBodySize]byte
+}
+
+// writeOldFile writes a database in the old layout, whose rows table has
+// its root in page 0: an internal node over two leaves when split, a lone
+// leaf otherwise, holding the rows with ids 1 to n.
+func writeOldFile(t *testing.T, path string, n int, split bool) {
+	t.Helper()
+	leaf := func(page *oldPage, ids []int, nextLeaf uint32_t) {
+		page.header.numCells = uint32_t(len(ids))
+		body := (*oldLeafPageBody)(unsafe.Pointer(&page.body))
+		body.nextLeaf = nextLeaf
+		for i, id := range ids {
+			row := &body.cells[i]
+			row.key = uint32_t(id)
+			row.value.id = uint32_t(id)
+			copy(row.value.username[:], fmt.Sprintf("user%d", id))
+			copy(row.value.email[:], fmt.Sprintf("user%d@example.com", id))
+		}
+	}
+	var ids []int
+	for i := 1; i <= n; i++ {
+		ids = append(ids, i)
+	}
+	var pages []oldPage
+	if !split {
+		pages = make([]oldPage, 1)
+		leaf(&pages[0], ids, 0)
+	} else {
+		pages = make([]oldPage, 3)
+		pages[0].header = PageHeader{pageType: PageInternal, numCells: 1}
+		root := (*InternalPageBody)(unsafe.Pointer(&pages[0].body))
+		root.cells[0] = InternalPageCell{value: 1, key: uint32_t(n / 2)}
+		root.rightChild = 2
+		leaf(&pages[1], ids[:n/2], 2)
+		leaf(&pages[2], ids[n/2:], 0)
+	}
+	pages[0].header.isRoot = 1
+	data := unsafe.Slice((*byte)(unsafe.Pointer(&pages[0])), len(pages)*int(PageSize))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenOldFormat(t *testing.T) {
+	tests := []struct {
+		name  string
+		n     int
+		split bool
+	}{
+		{"empty", 0, false},
+		{"one leaf", 2, false},
+		{"split", 2 * int(LeafNodeMaxCells), true},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "old.db")
+		writeOldFile(t, path, test.n, test.split)
+		if _, err := Open(path, &Options{ReadOnly: true}); !errors.Is(err, ErrOldFormat) {
+			t.Errorf("%s: read-only Open: err = %v, want ErrOldFormat", test.name, err)
+		}
+
+		// converted on the first writable open, which takes changes as usual
+		db, err := Open(path, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		for id := 1; id <= test.n; id++ {
+			row, err := db.Get(uint32(id))
+			if err != nil {
+				t.Fatalf("%s: Get(%d): %v", test.name, id, err)
+			}
+			if want := fmt.Sprintf("user%d@example.com", id); row.Email() != want {
+				t.Errorf("%s: row %d has email %q, want %q", test.name, id, row.Email(), want)
+			}
+		}
+		if err := db.Exec(fmt.Sprintf("insert %d new new@example.com", test.n+1)); err != nil {
+			t.Fatal(err)
+		}
+		kv, err := db.KV()
+		if err == nil {
+			err = kv.Put([]byte("k"), []byte("v"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = Open(path, &Options{ReadOnly: true})
+		if err != nil {
+			t.Fatalf("%s: read-only Open after converting: %v", test.name, err)
+		}
+		if got := scan(t, db); got != test.n+1 {
+			t.Errorf("%s: %d rows, want %d", test.name, got, test.n+1)
+		}
+		if kv, err = db.KV(); err == nil {
+			_, err = kv.Get([]byte("k"))
+		}
+		if err != nil {
+			t.Errorf("%s: Get of the key/value pair: %v", test.name, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if matches, _ := filepath.Glob(path + ".*.tmp"); len(matches) != 0 {
+			t.Errorf("%s: temporary files left behind: %v", test.name, matches)
+		}
+	}
+}
+
+func TestOpenOldFormatCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	writeOldFile(t, path, 2*int(LeafNodeMaxCells), true)
+	// point the root's right child back at the root
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zero [4]byte
+	if _, err := f.WriteAt(zero[:], int64(PageHeaderSize+uint32_t(unsafe.Offsetof(InternalPageBody{}.rightChild)))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := Open(path, nil); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Open: err = %v, want ErrCorrupt", err)
+	}
+}
@@ -0,0 +1,447 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+// builtNode is a page of a tree being built bottom-up, with the largest key
+// under it, which is what its parent keeps as the key of the child.
+type builtNode struct {
+	pageNum uint32_t
+	maxKey  uint32_t
+}
+
+// buildTable writes the rows next returns, in increasing id order, into a new
+// rows tree and returns its root. The leaves are laid out one after another,
+// then each level of internal nodes above them, every node filled to the
+// fraction fill of what it holds and the children spread evenly. next
+// returns nil when the rows run out.
+func (p *Pager) buildTable(next func() (*Row, error), fill float64) (uint32_t, error) {
+	perLeaf := uint32_t(fill*float64(LeafNodeMaxCells) + 0.5)
+	if perLeaf < 1 {
+		perLeaf = 1
+	}
+	perInternal := int(fill*float64(InternalNodeMaxCells+1) + 0.5)
+	if perInternal < 2 {
+		perInternal = 2
+	}
+	var level []builtNode
+	var leaf LeafPage
+	for {
+		row, err := next()
+		if err != nil {
+			return 0, err
+		}
+		if row == nil {
+			break
+		}
+		if len(level) > 0 {
+			last := level[len(level)-1]
+			if row.id == last.maxKey {
+				return 0, fmt.Errorf("%w %d", ErrDuplicateKey, row.id)
+			} else if row.id < last.maxKey {
+				return 0, fmt.Errorf("rows out of order: %d after %d", row.id, last.maxKey)
+			}
+		}
+		if len(level) == 0 || leaf.header.numCells == perLeaf {
+			var pageNum uint32_t
+			if leaf, pageNum, err = p.appendLeaf(level); err != nil {
+				return 0, err
+			}
+			level = append(level, builtNode{pageNum: pageNum})
+		}
+		*leaf.leafNodeCell(leaf.header.numCells) = LeafPageCell{key: row.id, value: *row}
+		leaf.header.numCells++
+		level[len(level)-1].maxKey = row.id
+	}
+	if len(level) == 0 {
+		_, pageNum, err := p.appendLeaf(nil)
+		if err != nil {
+			return 0, err
+		}
+		level = append(level, builtNode{pageNum: pageNum})
+	}
+
+	for len(level) > 1 {
+		var parents []builtNode
+		groups := (len(level) + perInternal - 1) / perInternal
+		if groups > len(level)/2 {
+			groups = len(level) / 2 // every node needs two children
+		}
+		for i := 0; i < groups; i++ {
+			group := level[len(level)*i/groups : len(level)*(i+1)/groups]
+			parent, err := p.appendInternal(group)
+			if err != nil {
+				return 0, err
+			}
+			parents = append(parents, parent)
+		}
+		level = parents
+	}
+	header, _, err := p.getPage(level[0].pageNum)
+	if err != nil {
+		return 0, err
+	}
+	header.isRoot = 1
+	p.markDirty(level[0].pageNum)
+	return level[0].pageNum, nil
+}
+
+// appendLeaf adds an empty leaf, on a page from the freelist or the end of
+// the file, after the last of the leaves built so far.
+func (p *Pager) appendLeaf(leaves []builtNode) (LeafPage, uint32_t, error) {
+	pageNum, err := p.allocatePage()
+	if err != nil {
+		return LeafPage{}, 0, err
+	}
+	header, body, err := p.getPage(pageNum)
+	if err != nil {
+		return LeafPage{}, 0, err
+	}
+	leaf := LeafPage{header: header, body: (*LeafPageBody)(body)}
+	leaf.setPageType(PageLeaf)
+	leaf.initializeLeafNode()
+	p.markDirty(pageNum)
+	if len(leaves) > 0 {
+		prev := leaves[len(leaves)-1].pageNum
+		prevHeader, prevBody, err := p.getPage(prev)
+		if err != nil {
+			return LeafPage{}, 0, err
+		}
+		prevLeaf := LeafPage{header: prevHeader, body: (*LeafPageBody)(prevBody)}
+		*prevLeaf.leafNodeNextLeaf() = pageNum
+		*leaf.leafNodePrevLeaf() = prev
+		p.markDirty(prev)
+	}
+	return leaf, pageNum, nil
+}
+
+// appendInternal adds an internal node over children, on a page from the
+// freelist or the end of the file.
+func (p *Pager) appendInternal(children []builtNode) (builtNode, error) {
+	pageNum, err := p.allocatePage()
+	if err != nil {
+		return builtNode{}, err
+	}
+	header, body, err := p.getPage(pageNum)
+	if err != nil {
+		return builtNode{}, err
+	}
+	page := InternalPage{header: header, body: (*InternalPageBody)(body)}
+	page.initializeInternalNode()
+	var keys, pageNums []uint32_t
+	for i, child := range children {
+		childHeader, _, err := p.getPage(child.pageNum)
+		if err != nil {
+			return builtNode{}, err
+		}
+		childHeader.parentPointer = pageNum
+		p.markDirty(child.pageNum)
+		pageNums = append(pageNums, child.pageNum)
+		if i < len(children)-1 {
+			keys = append(keys, child.maxKey)
+		}
+	}
+	page.setInternalNodeEntries(keys, pageNums)
+	p.markDirty(pageNum)
+	return builtNode{pageNum: pageNum, maxKey: children[len(children)-1].maxKey}, nil
+}
+
+// copyKVTree copies the key/value tree at pageNum in src into p and returns
+// the root of the copy. Its leaves are filled in key order as far as they go,
+// and nested buckets and overflow values are copied along.
+func (p *Pager) copyKVTree(src *Pager, pageNum uint32_t) (uint32_t, error) {
+	var level []kvInode
+	leaf := &kvNode{isLeaf: true}
+	_, err := src.kvScan(pageNum, nil, func(inode kvInode) (bool, error) {
+		switch {
+		case inode.flags&kvFlagBucket != 0:
+			root, err := p.copyKVTree(src, uint32_t(binary.LittleEndian.Uint32(inode.value)))
+			if err != nil {
+				return false, err
+			}
+			inode.value = make([]byte, 4)
+			binary.LittleEndian.PutUint32(inode.value, uint32(root))
+		case inode.flags&kvFlagOverflow != 0:
+			value, err := src.loadValue(inode)
+			if err != nil {
+				return false, err
+			}
+			if inode.value, inode.flags, err = p.storeValue(inode.key, value); err != nil {
+				return false, err
+			}
+		}
+		if len(leaf.inodes) > 0 && leaf.size()+KVLeafElementSize+uint32_t(len(inode.key)+len(inode.value)) > PageBodySize {
+			var err error
+			if level, err = p.appendKVNode(level, leaf); err != nil {
+				return false, err
+			}
+			leaf = &kvNode{isLeaf: true}
+		}
+		leaf.inodes = append(leaf.inodes, inode)
+		return true, nil
+	})
+	if err == nil {
+		level, err = p.appendKVNode(level, leaf)
+	}
+	for err == nil && len(level) > 1 {
+		var parents []kvInode
+		node := new(kvNode)
+		for _, inode := range level {
+			if len(node.inodes) > 0 && node.size()+KVInternalElementSize+uint32_t(len(inode.key)) > PageBodySize {
+				if parents, err = p.appendKVNode(parents, node); err != nil {
+					break
+				}
+				node = new(kvNode)
+			}
+			node.inodes = append(node.inodes, inode)
+		}
+		if err == nil {
+			parents, err = p.appendKVNode(parents, node)
+		}
+		level = parents
+	}
+	if err != nil {
+		return 0, err
+	}
+	return level[0].child, nil
+}
+
+// appendKVNode writes n to the end of the file and adds it to the level of
+// nodes a parent is to be built over.
+func (p *Pager) appendKVNode(level []kvInode, n *kvNode) ([]kvInode, error) {
+	n.pageNum = p.getUnusedPageNum()
+	if err := p.writeKVNode(n); err != nil {
+		return nil, err
+	}
+	var key []byte
+	if len(n.inodes) > 0 {
+		key = n.inodes[0].key
+	}
+	return append(level, kvInode{key: key, child: n.pageNum}), nil
+}
+
+// copyDatabase lays out in p, which must be empty, the database src holds
+// with the rows table at tableRoot: the meta page, then the rows table, then
+// the key/value buckets, each tree as tightly packed as it goes.
+func (p *Pager) copyDatabase(src *Pager, tableRoot uint32_t) error {
+	if _, err := p.initializeMeta(); err != nil {
+		return err
+	}
+	cursor, err := (&Table{pager: src, rootPageNum: tableRoot}).tableStart()
+	if err != nil {
+		return err
+	}
+	var row Row
+	newTableRoot, err := p.buildTable(func() (*Row, error) {
+		if cursor.endOfTable {
+			return nil, nil
+		}
+		value, err := cursor.cursorValue()
+		if err != nil {
+			return nil, err
+		}
+		row.deSerializeRow(unsafe.Pointer(value))
+		return &row, cursor.advance()
+	}, 1)
+	if err != nil {
+		return err
+	}
+
+	srcMeta, err := src.meta()
+	if err != nil {
+		return err
+	}
+	newKVRoot, err := p.copyKVTree(src, srcMeta.kvRoot)
+	if err != nil {
+		return err
+	}
+	meta, err := p.meta()
+	if err != nil {
+		return err
+	}
+	meta.tableRoot = newTableRoot
+	meta.kvRoot = newKVRoot
+	return nil
+}
+
+// vacuum rebuilds the database in new pages laid out by copyDatabase and
+// returns how many bytes smaller the database got.
+//
+// The caller must keep transactions off the table while it runs, and it fails
+// with ErrLocked while read transactions are open.
+func (t *Table) vacuum() (int64, error) {
+	p := t.pager
+	numPages := p.numPages
+	if err := p.reserve(); err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	readers := len(p.readers)
+	p.mu.Unlock()
+	if readers > 0 {
+		return 0, fmt.Errorf("%w: read transactions are open", ErrLocked)
+	}
+	// other processes must not read the file while it is replaced
+	if err := p.lockExclusive(); err != nil {
+		return 0, err
+	}
+	defer p.unlockExclusive()
+
+	err := p.rebuild(func(rebuilt *Pager) error {
+		return rebuilt.copyDatabase(p, t.rootPageNum)
+	})
+	if err != nil {
+		return 0, err
+	}
+	meta, err := p.meta()
+	if err != nil {
+		return 0, err
+	}
+	t.rootPageNum = meta.tableRoot
+	return int64(PageSize) * (int64(numPages) - int64(p.numPages)), nil
+}
+
+// rebuild lays out the database anew in the empty pager build fills, whose
+// pages then take the place of p's. A file is replaced in a single rename, by
+// a new one written next to it, so that it holds either database whole. The
+// exclusive lock must be held.
+func (p *Pager) rebuild(build func(rebuilt *Pager) error) error {
+	// the new file counts as a change to the old one
+	rebuilt := &Pager{storage: NewMemoryStorage(), changeCounter: p.changeCounter + 1}
+	var file *os.File
+	if p.fileDescriptor != nil {
+		path := p.fileDescriptor.Name()
+		var err error
+		file, err = os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+		if err != nil {
+			return fmt.Errorf("unable to open file: %w", err)
+		}
+		rebuilt.storage = NewFileStorage(file)
+	}
+	err := build(rebuilt)
+	if file == nil {
+		if err == nil {
+			err = p.replacePages(rebuilt)
+		}
+		return err
+	}
+	// the new file takes the place of the old one, permissions and all
+	var info os.FileInfo
+	if err == nil {
+		info, err = p.fileDescriptor.Stat()
+	}
+	if err == nil {
+		err = file.Chmod(info.Mode().Perm())
+	}
+	if err == nil {
+		err = rebuilt.writeBack()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = p.replaceFile(file.Name())
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// replaceFile renames the file at path over the database file and goes on
+// with it in its place. The exclusive lock must be held. Locks belong to the
+// old file, so other processes waiting for one get it on the old file once it
+// is closed; lockShared sees that it has been replaced and opens the new one.
+// The new file is whole before the rename and the reserved lock is held until
+// the vacuum ends, so the new file needs no lock of its own to be read.
+func (p *Pager) replaceFile(path string) error {
+	name := p.fileDescriptor.Name()
+	if err := os.Rename(path, name); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(name))
+	fd, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("unable to open file: %w", err)
+	}
+	if err := p.useFile(fd); err != nil {
+		return err
+	}
+	p.changeCounter++
+	return nil
+}
+
+// useFile makes fd the database file in place of the one open, whose pages
+// the cache no longer holds.
+func (p *Pager) useFile(fd *os.File) error {
+	size, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	if p.mapping != nil {
+		p.mapping.close()
+		p.mapping = &mapping{file: fd}
+	}
+	p.fileDescriptor.Close()
+	p.fileDescriptor = fd
+	p.storage = NewFileStorage(fd)
+	p.resetCache(uint32_t(size.Size() / int64(PageSize)))
+	p.generation++
+	return nil
+}
+
+// replacePages overwrites the pages of a storage that is not a file with
+// those of rebuilt, and cuts off the rest.
+func (p *Pager) replacePages(rebuilt *Pager) error {
+	for i := uint32_t(0); i < rebuilt.numPages; i++ {
+		if err := p.storage.WritePage(uint32(i), pageBytes(rebuilt.headers[i], rebuilt.bodies[i])); err != nil {
+			return fmt.Errorf("error writing: %w", err)
+		}
+	}
+	if err := p.storage.Truncate(int64(rebuilt.numPages) * int64(PageSize)); err != nil {
+		return err
+	}
+	if err := p.storage.Sync(); err != nil {
+		return fmt.Errorf("error syncing db file: %w", err)
+	}
+	p.resetCache(rebuilt.numPages)
+	p.generation++
+	return nil
+}
+
+// pageGeneration returns the generation of the pages p sees, which a view
+// shares with its base.
+func (p *Pager) pageGeneration() uint32_t {
+	if p.base != nil {
+		return p.base.pageGeneration()
+	}
+	return p.generation
+}
+
+// resetCache empties the page cache once the pages have been replaced under
+// it.
+func (p *Pager) resetCache(numPages uint32_t) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.headers = nil
+	p.bodies = nil
+	p.dirty = nil
+	p.history = nil
+	p.fresh = false
+	p.numPages = numPages
+}
+
+// syncDir syncs a directory, so that a rename in it lasts. Not every system
+// can, which is left alone.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,261 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// bigValueSize takes a value over several overflow pages.
+const bigValueSize = 3 * int(PageSize)
+
+func TestVacuum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// every other id first, so the leaves split half full
+	for _, start := range []int{1, 2} {
+		for i := start; i <= 600; i += 2 {
+			if err := db.Exec(fmt.Sprintf("insert %d user%d user%d@example.com", i, i, i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	kv, err := db.KV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := kv.CreateBucket([]byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := b.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(strings.Repeat("v", 100))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Put([]byte("big"), []byte(strings.Repeat("x", bigValueSize))); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i += 3 {
+		if err := b.Delete([]byte(fmt.Sprintf("key%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reclaimed, err := db.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed <= 0 || before.Size()-after.Size() != reclaimed {
+		t.Errorf("reclaimed %d bytes, file went from %d to %d", reclaimed, before.Size(), after.Size())
+	}
+
+	check := func(db *DB) {
+		t.Helper()
+		if got := scan(t, db); got != 600 {
+			t.Errorf("%d rows, want 600", got)
+		}
+		kv, err := db.KV()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := kv.Bucket([]byte("b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := b.Get([]byte("big")); err != nil || len(v) != bigValueSize {
+			t.Errorf("big value is %d bytes, %v", len(v), err)
+		}
+		for i := 0; i < 500; i++ {
+			v, err := b.Get([]byte(fmt.Sprintf("key%03d", i)))
+			if i%3 == 0 && err != ErrNotFound || i%3 != 0 && len(v) != 100 {
+				t.Errorf("key%03d = %q, %v", i, v, err)
+			}
+		}
+	}
+	check(db)
+	// the rebuilt trees take inserts and splits as before
+	for i := 601; i <= 700; i++ {
+		if err := db.Exec(fmt.Sprintf("insert %d u e", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Exec("insert 300 u e"); err != ErrDuplicateKey {
+		t.Errorf("inserting a duplicate after vacuum: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get(700); err != nil {
+		t.Errorf("Get(700) after reopening: %v", err)
+	}
+	if matches, _ := filepath.Glob(path + ".*.tmp"); len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestVacuumInMemory(t *testing.T) {
+	db, err := Open(MemoryPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Exec("vacuum"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 50; i++ {
+		if err := db.Exec(fmt.Sprintf("insert %d u e", 51-i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Exec("vacuum"); err != nil {
+		t.Fatal(err)
+	}
+	if got := scan(t, db); got != 50 {
+		t.Errorf("%d rows, want 50", got)
+	}
+
+	tx, err := db.BeginRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Vacuum(); err == nil || !strings.Contains(err.Error(), "read transactions") {
+		t.Errorf("Vacuum with a read transaction open: %v", err)
+	}
+	tx.Rollback()
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Exec("vacuum"); err == nil {
+		t.Error("vacuum ran inside a transaction")
+	}
+	tx.Rollback()
+}
+
+func TestShellVacuum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	var code int
+	out := captureStdout(t, func() {
+		code = RunShell(path, &ShellOptions{Commands: []string{
+			"insert 2 b b@example.com",
+			"insert 1 a a@example.com",
+			"vacuum",
+			"select",
+			"vacuum now",
+		}})
+	})
+	if code != ExitFailure || !strings.Contains(out, "Reclaimed 0 bytes.\nExecuted.\n(1, a, a@example.com)\n(2, b, b@example.com)\n") ||
+		!strings.Contains(out, "Syntax error") {
+		t.Errorf("exit code %d, output:\n%s", code, out)
+	}
+}
+
+func TestVacuumMovesBuckets(t *testing.T) {
+	for _, path := range []string{filepath.Join(t.TempDir(), "test.db"), MemoryPath} {
+		db, err := Open(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kv, err := db.KV()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := kv.CreateBucket([]byte("b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("k"), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Vacuum(); err != nil {
+			t.Fatal(err)
+		}
+
+		uses := []struct {
+			name string
+			fn   func() error
+		}{
+			{"Get", func() error {
+				_, err := b.Get([]byte("k"))
+				return err
+			}},
+			{"Put", func() error { return b.Put([]byte("k"), []byte("w")) }},
+			{"ForEach", func() error { return b.ForEach(func(key, value []byte) error { return nil }) }},
+			{"Bucket", func() error {
+				_, err := kv.Bucket([]byte("b"))
+				return err
+			}},
+		}
+		for _, use := range uses {
+			if err := use.fn(); !errors.Is(err, ErrBucketMoved) {
+				t.Errorf("%s: %s with a bucket from before the vacuum: err = %v, want ErrBucketMoved", path, use.name, err)
+			}
+		}
+		if kv, err = db.KV(); err == nil {
+			b, err = kv.Bucket([]byte("b"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := b.Get([]byte("k")); err != nil || string(v) != "v" {
+			t.Errorf("%s: Get after opening the bucket again = %q, %v", path, v, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVacuumKeepsFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no permission bits on windows")
+	}
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Exec("insert 1 u e"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("file mode after vacuum = %v, want 0600", mode)
+	}
+}
@@ -29,10 +29,10 @@ class MainTest(object):
 
 class LimitTest(object):
     def __init__(self, arg):
-        self.sampleCapacity = "insert {id} username{id} username{id}@test.com"
-        self.sampleField = f"insert 1 {'a'*32} {'a'*255}"
+        self.sampleCapacity = "insert {id} username{id} username{id}@test.com;"
+        self.sampleField = f"insert 1 {'a'*32} {'a'*255};"
         self.exit = ".exit"
-        self.select = "select"
+        self.select = "select;"
         self.tester = MainTest(arg)
 
     def function_test(self, i):
@@ -76,7 +76,7 @@ class LimitTest(object):
 
 
 if __name__ == '__main__':
-    testArgs = ('./main',)
+    testArgs = ('./main', 'test.db')
     tester = LimitTest(testArgs)
     for i in range(20):
         tester.function_test(i)
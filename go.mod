@@ -0,0 +1,3 @@
+module github.com/wss404/db_tutorial
+
+go 1.20